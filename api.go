@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var (
+	apiPort  = "8080"
+	apiToken string //only the health checks are served if not set
+)
+
+func init() {
+	if port := os.Getenv("API_PORT"); port != "" {
+		apiPort = port
+	}
+	apiToken = os.Getenv("API_TOKEN")
+}
+
+type apiRoute struct {
+	method  string
+	pattern *regexp.Regexp
+	handle  func(a *apiServer, w http.ResponseWriter, r *http.Request, args []string)
+}
+
+var apiRoutes = []apiRoute{
+	{"GET", regexp.MustCompile(`^/v1/apps$`), apiListApps},
+	{"GET", regexp.MustCompile(`^/v1/apps/(.+)/builds$`), apiListBuilds},
+	{"GET", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)$`), apiGetBuild},
+	{"GET", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)/logs$`), apiBuildLogs},
+	{"GET", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)/logs/events$`), apiStreamLogs},
+	{"GET", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)/logs/ws$`), apiWebSocketLogs},
+	{"POST", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)/retry$`), apiRetryBuild},
+	{"POST", regexp.MustCompile(`^/v1/builds/([0-9a-f]+)/cancel$`), apiCancelBuild},
+}
+
+//JSON API on API_PORT, requests must have an "Authorization: Bearer <API_TOKEN>" header or an access_token
+//parameter (browsers can't set headers on EventSource and WebSocket)
+type apiServer struct {
+	s     *server
+	token string
+}
+
+func newAPIServer(s *server, token string) *apiServer {
+	return &apiServer{s: s, token: token}
+}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//probes and metrics are served without token
+	if checks, ok := healthRoutes[r.URL.Path]; ok && r.Method == "GET" {
+		serveHealth(w, checks(a))
+		return
+	}
+	if r.URL.Path == "/metrics" && r.Method == "GET" {
+		metricsHandler.ServeHTTP(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "invalid or missing API token")
+		return
+	}
+
+	found := false
+	for _, route := range apiRoutes {
+		m := route.pattern.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		found = true
+		if route.method == r.Method {
+			route.handle(a, w, r, m[1:])
+			return
+		}
+	}
+	if found {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("unable to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIResponse(w, status, map[string]string{"error": msg})
+}
+
+func apiListApps(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	apps, err := a.s.listApps()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, apps)
+}
+
+func apiListBuilds(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	if !validAppName(args[0]) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid app name %q", args[0]))
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, registry.history(maxRecentBuilds, repoBuilds(args[0])))
+}
+
+func apiGetBuild(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, rec)
+}
+
+//the output of running builds is streamed until they finish
+func apiBuildLogs(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fw := &flushWriter{w: w}
+	if f, ok := w.(http.Flusher); ok {
+		fw.f = f
+	}
+	//nothing is written if the log isn't available
+	if err := registry.followLog(rec, fw); err == errNoLog {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("logs of build %s are not available", rec.ID))
+	}
+}
+
+//build the commit of a finished build again, in background. Git references are left untouched
+func apiRetryBuild(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	if rec.active() {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("build %s is still %s", rec.ID, rec.Status))
+		return
+	}
+
+	//commits of rejected pushes are not kept by git-receive-pack
+	src := &treeSource{storage: openStorage(filepath.Join(a.s.workingDir, rec.Repo)), hash: plumbing.NewHash(rec.Ref)}
+	if _, err := src.tree(); err != nil {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("commit %s not found in %s, it must be pushed again", rec.Ref, rec.Repo))
+		return
+	}
+
+	options := rec.pushOptions
+	if options == nil {
+		//builds of previous dockpack processes only have the redacted options
+		for _, o := range rec.PushOptions {
+			if strings.HasPrefix(o, "env.") {
+				writeAPIError(w, http.StatusConflict, fmt.Sprintf("env values of build %s are not kept across restarts, it must be pushed again", rec.ID))
+				return
+			}
+		}
+		options = rec.PushOptions
+	}
+
+	req := &buildRequest{Repo: rec.Repo, Ref: rec.Ref, RefName: rec.RefName, PushOptions: options, Pusher: "api"}
+	var out bytes.Buffer
+	cfg, opts, err := prepareBuild(&out, req)
+	if err != nil || opts == nil {
+		writeAPIError(w, http.StatusConflict, strings.TrimSpace(out.String()))
+		return
+	}
+
+	retry, err := startAsyncBuild(ioutil.Discard, req, cfg, opts, src)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	log.Infof("build %s retried by build %s", rec.ID, retry.ID)
+	b, _ := registry.get(retry.ID)
+	writeAPIResponse(w, http.StatusAccepted, b)
+}
+
+func apiCancelBuild(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	if err := registry.cancel(rec.ID); err != nil {
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusAccepted, map[string]string{"id": rec.ID, "status": "cancelling"})
+}
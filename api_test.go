@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+func newTestAPI(t *testing.T) (*apiServer, func()) {
+	dir, err := ioutil.TempDir("", "dockpack-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, app := range []string{"app", "acme/api"} {
+		if _, err := git.PlainInit(filepath.Join(dir, app), true); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return newAPIServer(&server{workingDir: dir}, "secret"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func apiRequest(a *apiServer, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIAuth(t *testing.T) {
+	a, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	for _, token := range []string{"", "wrong"} {
+		if w := apiRequest(a, "GET", "/v1/apps", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, w.Code)
+		}
+	}
+	if w := apiRequest(a, "GET", "/v1/apps", "secret"); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+
+	//the API can't be used without token
+	a.token = ""
+	if w := apiRequest(a, "GET", "/v1/apps", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without API token, got %d", w.Code)
+	}
+}
+
+func TestAPIRoutes(t *testing.T) {
+	a, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	w := apiRequest(a, "GET", "/v1/apps", "secret")
+	var apps []string
+	if err := json.NewDecoder(w.Body).Decode(&apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0] != "acme/api" || apps[1] != "app" {
+		t.Errorf("unexpected apps %v", apps)
+	}
+
+	rec, _, _ := registry.start(context.Background(), &buildRequest{Repo: "acme/api", Ref: strings.Repeat("a", 40), RefName: "refs/heads/master", PushOptions: []string{"env.TOKEN=secret-value"}})
+	rec.log.Write([]byte("building\n"))
+
+	w = apiRequest(a, "GET", "/v1/apps/acme/api/builds", "secret")
+	var builds []buildRecord
+	if err := json.NewDecoder(w.Body).Decode(&builds); err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].ID != rec.ID {
+		t.Errorf("unexpected builds %v", builds)
+	}
+
+	if w := apiRequest(a, "GET", "/v1/builds/"+rec.ID, "secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"queued"`) {
+		t.Errorf("unexpected build %d %s", w.Code, w.Body.String())
+	} else if strings.Contains(w.Body.String(), "secret-value") || !strings.Contains(w.Body.String(), `"push_options":["env.TOKEN"]`) {
+		t.Errorf("expected env values to be redacted, got %s", w.Body.String())
+	}
+	if w := apiRequest(a, "POST", "/v1/builds/"+rec.ID+"/retry", "secret"); w.Code != http.StatusConflict {
+		t.Errorf("expected running build retry to be refused, got %d", w.Code)
+	}
+	if w := apiRequest(a, "POST", "/v1/builds/"+rec.ID+"/cancel", "secret"); w.Code != http.StatusAccepted {
+		t.Errorf("expected build to be cancelled, got %d %s", w.Code, w.Body.String())
+	}
+	registry.finish(rec, nil, errBuildCancelled)
+
+	if w := apiRequest(a, "GET", "/v1/builds/"+rec.ID+"/logs", "secret"); w.Body.String() != "building\n" {
+		t.Errorf("unexpected logs %q", w.Body.String())
+	}
+	if w := apiRequest(a, "POST", "/v1/builds/"+rec.ID+"/cancel", "secret"); w.Code != http.StatusConflict {
+		t.Errorf("expected finished build cancel to fail, got %d", w.Code)
+	}
+
+	//the commit was never pushed to the repository
+	if w := apiRequest(a, "POST", "/v1/builds/"+rec.ID+"/retry", "secret"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "pushed again") {
+		t.Errorf("expected unknown commit retry to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	errors := map[string]int{
+		"GET /v1/builds/123456":                http.StatusNotFound,
+		"GET /v1/apps/App/builds":              http.StatusBadRequest,
+		"DELETE /v1/builds/" + rec.ID:          http.StatusMethodNotAllowed,
+		"GET /v1/builds/" + rec.ID + "/cancel": http.StatusMethodNotAllowed,
+		"GET /builds":                          http.StatusNotFound,
+	}
+	for req, code := range errors {
+		parts := strings.SplitN(req, " ", 2)
+		if w := apiRequest(a, parts[0], parts[1], "secret"); w.Code != code {
+			t.Errorf("%s: expected %d, got %d", req, code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//Authenticator checks users public keys and their access to repositories
+type Authenticator interface {
+	//AuthenticateKey checks that pubKey (authorized_keys format) can be used by user to connect
+	//from addr, returns the identity to use for authorization
+	AuthenticateKey(user, pubKey string, addr net.Addr) (string, error)
+
+	//Authorize checks that identity can push on repo
+	Authorize(identity, repo string) error
+}
+
+//Multi combines several authenticators: a key is accepted if one of them accepts it, access to
+//repositories is then only checked by the authenticator that accepted the key. Identities of
+//different authenticators are unrelated (e.g. a file user and a certificate principal may have
+//the same name), so Multi is not an Authenticator itself
+type Multi []Authenticator
+
+//AuthenticateKey returns the identity given by the first authenticator accepting pubKey and the
+//index of this authenticator, to be given to Authorize
+func (m Multi) AuthenticateKey(user, pubKey string, addr net.Addr) (string, int, error) {
+	errs := []string{}
+	for i, a := range m {
+		identity, err := a.AuthenticateKey(user, pubKey, addr)
+		if err == nil {
+			return identity, i, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return "", -1, fmt.Errorf("%s", strings.Join(errs, ", "))
+}
+
+//Authorize checks that identity, authenticated by the authenticator at index backend, can push on repo
+func (m Multi) Authorize(backend int, identity, repo string) error {
+	if backend < 0 || backend >= len(m) {
+		return fmt.Errorf("unknown authentication backend %d", backend)
+	}
+	return m[backend].Authorize(identity, repo)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMultiAuthorizesWithAuthenticatingBackend(t *testing.T) {
+	fileAuth, cleanup := newTestFileAuth(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "dockpack_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestSigner(t)
+	caPath := filepath.Join(dir, "user_ca.pub")
+	if err := ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//without principals file all principals can access all repositories
+	certAuth, err := NewCertAuth(caPath, filepath.Join(dir, "principals.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Multi{fileAuth, certAuth}
+
+	//bob is restricted to api and tools_* by the file, the certificate backend must not grant him more
+	identity, backend, err := m.AuthenticateKey("git", bobKey, testAddr)
+	if err != nil || identity != "bob" || backend != 0 {
+		t.Fatalf("unexpected authentication of bob: %q %d %v", identity, backend, err)
+	}
+	if err := m.Authorize(backend, identity, "api"); err != nil {
+		t.Errorf("expected bob to access api, got %v", err)
+	}
+	if err := m.Authorize(backend, identity, "web"); err == nil {
+		t.Error("expected bob to be denied access to web")
+	}
+
+	identity, backend, err = m.AuthenticateKey("bob", newTestCert(t, ca, []string{"bob"}, time.Now().Add(time.Hour)), testAddr)
+	if err != nil || identity != "bob" || backend != 1 {
+		t.Fatalf("unexpected authentication of bob's certificate: %q %d %v", identity, backend, err)
+	}
+	if err := m.Authorize(backend, identity, "web"); err != nil {
+		t.Errorf("expected bob's certificate to access web, got %v", err)
+	}
+
+	if _, _, err := m.AuthenticateKey("git", eveKey, testAddr); err == nil {
+		t.Error("expected eve to be rejected")
+	}
+	if err := m.Authorize(2, "bob", "api"); err == nil {
+		t.Error("expected an unknown backend to be denied")
+	}
+}
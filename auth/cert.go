@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//CertAuth authenticates users with OpenSSH certificates signed by a trusted user CA,
+//the ssh user must be one of the certificate principals
+//
+//principals access is read from an optional JSON file mapping principals to repos patterns:
+//
+//  {"alice": ["api", "tools_*"], "ops": ["*"]}
+//
+//all principals can access all repositories without this file
+type CertAuth struct {
+	CAKeys         []ssh.PublicKey
+	PrincipalsPath string
+}
+
+//caPath is an authorized_keys style file with the CA public keys
+func NewCertAuth(caPath, principalsPath string) (*CertAuth, error) {
+	data, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &CertAuth{PrincipalsPath: principalsPath}
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", caPath, err)
+		}
+		a.CAKeys = append(a.CAKeys, key)
+		data = rest
+	}
+	if len(a.CAKeys) == 0 {
+		return nil, fmt.Errorf("%s: no CA key found", caPath)
+	}
+
+	if _, err := a.principals(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (auth *CertAuth) isUserAuthority(key ssh.PublicKey) bool {
+	for _, ca := range auth.CAKeys {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+//principals to repos patterns, nil if there is no principals file
+func (auth *CertAuth) principals() (map[string][]string, error) {
+	if auth.PrincipalsPath == "" {
+		return nil, nil
+	}
+	f, err := os.Open(auth.PrincipalsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	principals := map[string][]string{}
+	if err := json.NewDecoder(f).Decode(&principals); err != nil {
+		return nil, fmt.Errorf("%s: %v", auth.PrincipalsPath, err)
+	}
+	return principals, nil
+}
+
+//check that pubKey is a valid user certificate signed by a trusted CA for user, connecting from an
+//address allowed by the certificate. The identity is the user
+func (auth *CertAuth) AuthenticateKey(user, pubKey string, addr net.Addr) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("permission denied (not a certificate)")
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return "", fmt.Errorf("permission denied (not a user certificate)")
+	}
+	if !auth.isUserAuthority(cert.SignatureKey) {
+		return "", fmt.Errorf("permission denied (unknown certificate authority)")
+	}
+	//certificates without principals are valid for any user
+	if len(cert.ValidPrincipals) == 0 {
+		return "", fmt.Errorf("permission denied (certificate without principals)")
+	}
+	if sourceAddress, ok := cert.CriticalOptions["source-address"]; ok {
+		if err := checkSourceAddress(addr, sourceAddress); err != nil {
+			return "", err
+		}
+	}
+
+	//checks the principals, the validity period, the signature and rejects other critical options
+	checker := &ssh.CertChecker{SupportedCriticalOptions: []string{"source-address"}}
+	if err := checker.CheckCert(user, cert); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+//sourceAddress is a comma separated list of addresses and CIDR blocks the certificate can be used from
+func checkSourceAddress(addr net.Addr, sourceAddress string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("permission denied (unknown client address %v for source-address)", addr)
+	}
+	for _, source := range strings.Split(sourceAddress, ",") {
+		if ip := net.ParseIP(source); ip != nil {
+			if ip.Equal(tcpAddr.IP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return fmt.Errorf("permission denied (invalid source-address %q)", source)
+		}
+		if ipNet.Contains(tcpAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("permission denied (source-address doesn't allow %s)", tcpAddr.IP)
+}
+
+//check that principal can access repo
+func (auth *CertAuth) Authorize(principal, repo string) error {
+	principals, err := auth.principals()
+	if err != nil {
+		return err
+	}
+	if principals == nil {
+		return nil
+	}
+	for _, pattern := range principals[principal] {
+		if ok, err := path.Match(pattern, repo); err == nil && ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("not authorized to push on %s", repo)
+}
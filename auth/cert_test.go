@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//address of the clients of the tests
+var testAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 51234}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+//returns the certificate in authorized_keys format
+func newTestCert(t *testing.T, ca ssh.Signer, principals []string, validBefore time.Time) string {
+	return newTestCertWithOptions(t, ca, principals, validBefore, nil)
+}
+
+func newTestCertWithOptions(t *testing.T, ca ssh.Signer, principals []string, validBefore time.Time, criticalOptions map[string]string) string {
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: criticalOptions},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	pk := ssh.MarshalAuthorizedKey(cert)
+	return string(pk[:len(pk)-1])
+}
+
+func TestCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockpack_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestSigner(t)
+	caPath := filepath.Join(dir, "user_ca.pub")
+	if err := ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	principalsPath := filepath.Join(dir, "principals.json")
+	if err := ioutil.WriteFile(principalsPath, []byte(`{"alice": ["api", "tools_*"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewCertAuth(caPath, principalsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in1h := time.Now().Add(time.Hour)
+	sourceAddress := func(addrs string) string {
+		return newTestCertWithOptions(t, ca, []string{"alice"}, in1h, map[string]string{"source-address": addrs})
+	}
+	tests := []struct {
+		user string
+		key  string
+		ok   bool
+	}{
+		{"alice", newTestCert(t, ca, []string{"alice", "ops"}, in1h), true},
+		{"alice", sourceAddress("192.168.0.1,10.0.0.0/8"), true},
+		{"alice", sourceAddress("10.1.2.3"), true},
+		{"alice", sourceAddress("192.168.0.0/16,10.1.2.4"), false}, //not from an allowed address
+		{"alice", sourceAddress("10.1.2.3/33"), false},             //invalid source address
+		{"alice", newTestCertWithOptions(t, ca, []string{"alice"}, in1h, map[string]string{"force-command": "id"}), false},
+		{"bob", newTestCert(t, ca, []string{"alice"}, in1h), false},                           //not a principal
+		{"alice", newTestCert(t, ca, []string{"alice"}, time.Now().Add(-time.Second)), false}, //expired
+		{"alice", newTestCert(t, ca, nil, in1h), false},                                       //no principals
+		{"alice", newTestCert(t, newTestSigner(t), []string{"alice"}, in1h), false},           //unknown CA
+		{"alice", string(ssh.MarshalAuthorizedKey(newTestSigner(t).PublicKey())), false},      //not a certificate
+	}
+	for i, test := range tests {
+		identity, err := a.AuthenticateKey(test.user, test.key, testAddr)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: expected ok %v, got error %v", i, test.ok, err)
+		}
+		if test.ok && identity != test.user {
+			t.Errorf("%d: expected identity %q, got %q", i, test.user, identity)
+		}
+	}
+
+	for _, test := range []struct {
+		principal string
+		repo      string
+		ok        bool
+	}{
+		{"alice", "api", true},
+		{"alice", "tools_ci", true},
+		{"alice", "web", false},
+		{"ops", "api", false},
+	} {
+		err := a.Authorize(test.principal, test.repo)
+		if (err == nil) != test.ok {
+			t.Errorf("%s on %s: expected ok %v, got error %v", test.principal, test.repo, test.ok, err)
+		}
+	}
+}
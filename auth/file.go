@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//FileAuth authenticates users with an authorized_keys file, each key is mapped to a user
+//and optionally restricted to some repositories using options:
+//
+//  user="alice",repos="my_app,tools_*" ssh-ed25519 AAAA... alice@laptop
+//
+//the key comment is used when the user option is missing, repos patterns use path.Match syntax,
+//all repositories are allowed when the repos option is missing
+type FileAuth struct {
+	Path string
+}
+
+type keyEntry struct {
+	key   ssh.PublicKey
+	user  string
+	repos []string
+}
+
+func NewFileAuth(path string) (*FileAuth, error) {
+	a := &FileAuth{Path: path}
+	//fail early on missing or invalid files, the file is read again on each authentication so it can be edited without restarting
+	if _, err := a.entries(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (auth *FileAuth) entries() ([]*keyEntry, error) {
+	data, err := ioutil.ReadFile(auth.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*keyEntry{}
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", auth.Path, n+1, err)
+		}
+
+		e := &keyEntry{key: key, user: comment}
+		for _, opt := range options {
+			name, value, err := parseOption(opt)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", auth.Path, n+1, err)
+			}
+			switch name {
+			case "user":
+				e.user = value
+			case "repos":
+				e.repos = strings.Split(value, ",")
+			}
+		}
+		if e.user == "" {
+			return nil, fmt.Errorf("%s:%d: missing user", auth.Path, n+1)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//parse name="value" options, options without value are ignored
+func parseOption(opt string) (string, string, error) {
+	i := strings.Index(opt, "=")
+	if i == -1 {
+		return opt, "", nil
+	}
+	name, value := opt[:i], opt[i+1:]
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", "", fmt.Errorf("invalid option %s, value must be quoted", name)
+	}
+	return name, value[1 : len(value)-1], nil
+}
+
+//check that pubKey is in the file, the identity is the user of the matching entry
+func (auth *FileAuth) AuthenticateKey(user, pubKey string, addr net.Addr) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	entries, err := auth.entries()
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if bytes.Equal(e.key.Marshal(), key.Marshal()) {
+			return e.user, nil
+		}
+	}
+	return "", fmt.Errorf("permission denied (public key)")
+}
+
+//check that one of user's keys allows repo
+func (auth *FileAuth) Authorize(user, repo string) error {
+	entries, err := auth.entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.user != user {
+			continue
+		}
+		if e.repos == nil {
+			return nil
+		}
+		for _, pattern := range e.repos {
+			if ok, err := path.Match(strings.TrimSpace(pattern), repo); err == nil && ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("not authorized to push on %s", repo)
+}
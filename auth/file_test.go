@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	aliceKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ/R4kV31shDmKjIo2hNUNdxxzJE/IgcxcREI00EyGDD"
+	bobKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAII5NM0vzZipXwMYdW0QCOPCC5IXM1qKH/IR+Ed8VRcx3"
+	eveKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJGD+k8B/5BOOoMuyURxo5m2Tdp2u7zFdkvBOhPBi89k"
+)
+
+//returns a FileAuth on a temporary authorized_keys file and a func to remove it
+func newTestFileAuth(t *testing.T) (*FileAuth, func()) {
+	dir, err := ioutil.TempDir("", "dockpack_auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	content := "# dockpack users\n" +
+		aliceKey + " alice@laptop\n" +
+		`user="bob",repos="api,tools_*" ` + bobKey + "\n"
+	path := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	a, err := NewFileAuth(path)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return a, cleanup
+}
+
+func TestFileAuthenticateKey(t *testing.T) {
+	a, cleanup := newTestFileAuth(t)
+	defer cleanup()
+
+	tests := []struct {
+		key      string
+		identity string
+		ok       bool
+	}{
+		{aliceKey, "alice@laptop", true},
+		{bobKey + " bob@desktop", "bob", true},
+		{eveKey, "", false},
+	}
+	for _, test := range tests {
+		identity, err := a.AuthenticateKey("git", test.key, testAddr)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %v, got error %v", test.key, test.ok, err)
+		}
+		if identity != test.identity {
+			t.Errorf("%s: expected identity %q, got %q", test.key, test.identity, identity)
+		}
+	}
+}
+
+func TestFileAuthorize(t *testing.T) {
+	a, cleanup := newTestFileAuth(t)
+	defer cleanup()
+
+	tests := []struct {
+		user string
+		repo string
+		ok   bool
+	}{
+		{"alice@laptop", "api", true},
+		{"alice@laptop", "web", true},
+		{"bob", "api", true},
+		{"bob", "tools_ci", true},
+		{"bob", "web", false},
+		{"eve", "api", false},
+	}
+	for _, test := range tests {
+		err := a.Authorize(test.user, test.repo)
+		if (err == nil) != test.ok {
+			t.Errorf("%s on %s: expected ok %v, got error %v", test.user, test.repo, test.ok, err)
+		}
+	}
+}
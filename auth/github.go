@@ -2,7 +2,9 @@ package auth
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
@@ -36,8 +38,17 @@ func NewGithubAuth() (*GithubAuth, error) {
 	}, nil
 }
 
+//repositories of an organization (org/app) are looked up in the organization instead of the owner
+func (auth *GithubAuth) ownerAndRepo(repo string) (string, string) {
+	if i := strings.Index(repo, "/"); i != -1 {
+		return repo[:i], repo[i+1:]
+	}
+	return auth.Owner, repo
+}
+
 func (auth *GithubAuth) checkUserIsWriteCollaborator(user, repo string) error {
-	colls, _, err := auth.Client.Repositories.ListCollaborators(auth.Owner, repo, nil)
+	owner, name := auth.ownerAndRepo(repo)
+	colls, _, err := auth.Client.Repositories.ListCollaborators(owner, name, nil)
 	if err != nil {
 		return err
 	}
@@ -66,6 +77,22 @@ func (auth *GithubAuth) checkPublicKey(user, pubKey string) error {
 	return fmt.Errorf("permission denied (public key)")
 }
 
+//CheckToken checks that the github token is valid
+func (auth *GithubAuth) CheckToken() error {
+	_, _, err := auth.Client.Users.Get("")
+	return err
+}
+
+//check that pubKey is one of user's github keys, the identity is the github user
+func (auth *GithubAuth) AuthenticateKey(user, pubKey string, addr net.Addr) (string, error) {
+	return user, auth.checkPublicKey(user, pubKey)
+}
+
+//check that user is a collaborator with push permission on the github repo
+func (auth *GithubAuth) Authorize(user, repo string) error {
+	return auth.checkUserIsWriteCollaborator(user, repo)
+}
+
 func (auth *GithubAuth) Authenticate(user, pubKey, repo string) error {
 	if err := auth.checkPublicKey(user, pubKey); err != nil {
 		return err
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 const (
@@ -21,6 +27,9 @@ var (
 	buildImage    = "gliderlabs/herokuish"
 	buildImageTag = "latest"
 
+	//joins the organization and the app in image names, empty to drop the organization
+	imageOrgSeparator = ""
+
 	pullAuthOpts docker.AuthConfiguration
 	pushAuthOpts docker.AuthConfiguration
 )
@@ -34,6 +43,16 @@ func init() {
 		buildImageTag = tag
 	}
 
+	//separators allowed in docker repository names, "/" needs a registry accepting nested repositories
+	if sep := os.Getenv("IMAGE_ORG_SEPARATOR"); sep != "" {
+		switch sep {
+		case "/", "-", "_", "__", ".":
+			imageOrgSeparator = sep
+		default:
+			panic(fmt.Sprintf("invalid IMAGE_ORG_SEPARATOR: %q", sep))
+		}
+	}
+
 	//pull auth (to get the build image)
 	pullAuthOpts = docker.AuthConfiguration{
 		Username:      os.Getenv("PULL_REGISTRY_USERNAME"),
@@ -64,53 +83,228 @@ func init() {
 }
 
 type builder struct {
-	client *docker.Client
-	repo   string
-	ref    string
-	writer io.Writer
+	client  *docker.Client
+	repo    string
+	ref     string
+	branch  string
+	release []string //release tags, empty if not a release build
+	opts    *buildOptions
+	src     buildSource
+	writer  io.Writer
+}
+
+//build request sent by the pre-receive hook for each pushed ref
+type buildRequest struct {
+	Repo        string   `json:"repo"`
+	Ref         string   `json:"ref"`
+	RefName     string   `json:"ref_name"`
+	PushOptions []string `json:"push_options,omitempty"`
+	Async       bool     `json:"async,omitempty"` //sent by the post-receive hook, the ref is already updated
+	Pusher      string   `json:"pusher,omitempty"`
+}
+
+func (r *buildRequest) branch() string {
+	if !strings.HasPrefix(r.RefName, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(r.RefName, "refs/heads/")
+}
+
+//git tag pushed, empty if the ref is not a tag
+func (r *buildRequest) gitTag() string {
+	if !strings.HasPrefix(r.RefName, "refs/tags/") {
+		return ""
+	}
+	return strings.TrimPrefix(r.RefName, "refs/tags/")
+}
+
+//a release is a semver tag push (e.g. v1.2.3)
+func (r *buildRequest) isRelease() bool {
+	return releaseTags(r.gitTag(), nil) != nil
+}
+
+var semverRegexp = regexp.MustCompile(`^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?$`)
+
+type semver struct {
+	major, minor, patch int
+	preRelease          string
+}
+
+func parseSemver(tag string) (*semver, bool) {
+	m := semverRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return nil, false
+	}
+	v := &semver{preRelease: m[4]}
+	v.major, _ = strconv.Atoi(m[1])
+	v.minor, _ = strconv.Atoi(m[2])
+	v.patch, _ = strconv.Atoi(m[3])
+	return v, true
+}
+
+//returns the image tags of a release: the git tag itself plus the major.minor and major aliases
+//(e.g. v1.2.3, v1.2, v1). Aliases are only moved if tag is the highest release of their line among
+//released (the tags already pushed): pushing v1.1.5 after v1.2.0 tags v1.1 but leaves v1 on v1.2.0.
+//Pre-releases are only tagged with the git tag. Returns nil if tag is not semver
+func releaseTags(tag string, released []string) []string {
+	v, ok := parseSemver(tag)
+	if !ok {
+		return nil
+	}
+	if v.preRelease != "" {
+		return []string{tag}
+	}
+	highestMinor, highestMajor := true, true
+	for _, t := range released {
+		r, ok := parseSemver(t)
+		if !ok || r.preRelease != "" || r.major != v.major {
+			continue
+		}
+		if r.minor > v.minor || (r.minor == v.minor && r.patch > v.patch) {
+			highestMajor = false
+		}
+		if r.minor == v.minor && r.patch > v.patch {
+			highestMinor = false
+		}
+	}
+	tags := []string{tag}
+	if highestMinor {
+		tags = append(tags, fmt.Sprintf("v%d.%d", v.major, v.minor))
+	}
+	if highestMajor {
+		tags = append(tags, fmt.Sprintf("v%d", v.major))
+	}
+	return tags
+}
+
+//tags already pushed to the repository of the app, the pushed tag may not be stored yet
+func repoTags(repo string) ([]string, error) {
+	refs, err := openStorage(filepath.Join("sandbox", repo)).IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+		return nil
+	})
+	return tags, err
+}
+
+//sources of the app to build
+type buildSource interface {
+	archive() (io.ReadCloser, error)  //tar archive of the sources
+	procfile() (io.ReadCloser, error) //Procfile of the app
+	cleanup() error                   //remove temporary files, if any
+}
+
+//sources extracted in the sandbox by the pre-receive hook
+type hookSource struct {
+	repo string
+	ref  string
+}
+
+func (s *hookSource) archive() (io.ReadCloser, error) {
+	return os.Open(filepath.Join("sandbox", fmt.Sprintf("%s_%s.tar", s.repo, s.ref)))
+}
+
+//read from the archive, the sources of another push of the repo may be extracted concurrently
+func (s *hookSource) procfile() (io.ReadCloser, error) {
+	f, err := s.archive()
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			f.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("no Procfile in %s", s.ref)
+			}
+			return nil, err
+		}
+		if hdr.Name == "Procfile" {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, f}, nil
+		}
+	}
+}
+
+//archive can be removed once the build is done (it's inside the build container)
+func (s *hookSource) cleanup() error {
+	return os.RemoveAll(filepath.Join("sandbox", fmt.Sprintf("%s_%s.tar", s.repo, s.ref)))
 }
 
 type buildResult struct {
-	Repo      string            `json:"repo"`
-	ImageName string            `json:"image_name"`
-	ImageTag  string            `json:"image_tag"`
-	Procfile  map[string]string `json:"procfile,omitempty"`
+	Status       buildStatus       `json:"status"`
+	Repo         string            `json:"repo"`
+	Branch       string            `json:"branch,omitempty"`
+	Release      bool              `json:"release"`
+	GitTag       string            `json:"git_tag,omitempty"`
+	ImageName    string            `json:"image_name"`
+	ImageTag     string            `json:"image_tag"`
+	ImageAliases []string          `json:"image_aliases,omitempty"`
+	Procfile     map[string]string `json:"procfile,omitempty"`
+	Error        string            `json:"error,omitempty"`
 }
 
-func newBuilder(w io.Writer, repo, ref string) (*builder, error) {
+func newBuilder(w io.Writer, req *buildRequest, opts *buildOptions, src buildSource) (*builder, error) {
 	client, err := docker.NewClient(endpoint)
 	if err != nil {
 		return nil, err
 	}
+	var release []string
+	if tag := req.gitTag(); tag != "" {
+		released, err := repoTags(req.Repo)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the tags of %s: %v", req.Repo, err)
+		}
+		release = releaseTags(tag, released)
+	}
 	return &builder{
-		client: client,
-		repo:   repo,
-		ref:    ref,
-		writer: w,
+		client:  client,
+		repo:    req.Repo,
+		ref:     req.Ref,
+		branch:  req.branch(),
+		release: release,
+		opts:    opts,
+		src:     src,
+		writer:  w,
 	}, nil
 }
 
-func (b *builder) build() (*buildResult, error) {
+func (b *builder) build(ctx context.Context) (*buildResult, error) {
 
+	//docker calls are given ctx so a cancelled build stops right away
 	//check if herokuish latest exists
 	pullOpts := docker.PullImageOptions{
+		Context:    ctx,
 		Repository: buildImage,
 		Tag:        buildImageTag,
 	}
 
 	b.logLine(fmt.Sprintf("-----> Pulling %s:%s image if required ...", buildImage, buildImageTag))
 
+	start := time.Now()
 	if err := b.client.PullImage(pullOpts, pullAuthOpts); err != nil {
 		return nil, err
 	}
+	start = observePhase("pull", start)
 
 	//create a container for the build
 	b.logLine("-----> Preparing build container")
 	createOpts := docker.CreateContainerOptions{
-		Name: fmt.Sprintf("%s_%s", b.repo, b.ref),
+		Context: ctx,
+		Name:    fmt.Sprintf("%s_%s", strings.Replace(b.repo, "/", "_", -1), b.ref), //container names can't contain slashes
 		Config: &docker.Config{
 			Image: fmt.Sprintf("%s:%s", buildImage, buildImageTag),
 			Cmd:   []string{"/build"},
+			Env:   b.opts.Env,
 		},
 		HostConfig: &docker.HostConfig{},
 	}
@@ -130,27 +324,42 @@ func (b *builder) build() (*buildResult, error) {
 		}
 	}()
 
+	//kill the container if the build is cancelled, this stops the logs streaming below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := b.client.KillContainer(docker.KillContainerOptions{ID: container.ID}); err != nil {
+				log.Errorf("unable to kill container: %v", err)
+			}
+		case <-done:
+		}
+	}()
+
 	//upload source code and cache (if any) inside the container
 	b.logLine("-----> Uploading sources and cache into the container")
-	srcTarPath := filepath.Join("sandbox", fmt.Sprintf("%s_%s.tar", b.repo, b.ref))
-	uploads := map[string]string{
-		srcTarPath: "/tmp/build",
+	srcTar, err := b.src.archive()
+	if err != nil {
+		return nil, err
+	}
+	defer srcTar.Close()
+	uploads := map[string]io.Reader{
+		"/tmp/build": srcTar,
 	}
 	cachePath := filepath.Join("sandbox", fmt.Sprintf("%s_cache.tar", b.repo))
-	if _, err := os.Stat(cachePath); err == nil {
+	if b.opts.NoCache {
+		b.logLine("-----> Building without cache")
+	} else if cacheTar, err := os.Open(cachePath); err == nil {
 		//cache tar exists
-		uploads[cachePath] = "/tmp/"
+		defer cacheTar.Close()
+		uploads["/tmp/"] = cacheTar
 	}
 
-	for src, dest := range uploads {
-		srcTar, err := os.Open(src)
-		if err != nil {
-			return nil, err
-		}
-		defer srcTar.Close()
-
+	for dest, tar := range uploads {
 		uploadOpts := docker.UploadToContainerOptions{
-			InputStream: srcTar,
+			Context:     ctx,
+			InputStream: tar,
 			Path:        dest, //see herokuish doc for more informations
 		}
 
@@ -158,11 +367,7 @@ func (b *builder) build() (*buildResult, error) {
 			return nil, err
 		}
 	}
-
-	//tar can be removed, it's inside the build container
-	if err := os.RemoveAll(srcTarPath); err != nil {
-		return nil, err
-	}
+	start = observePhase("upload", start)
 
 	//start the container, this will start the build
 	if err := b.client.StartContainer(container.ID, &docker.HostConfig{}); err != nil {
@@ -185,6 +390,9 @@ func (b *builder) build() (*buildResult, error) {
 
 	//wait until the container stops and check if everything went fine
 	statusCode, err := b.client.WaitContainer(container.ID)
+	if ctx.Err() != nil {
+		return nil, errBuildCancelled
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +400,7 @@ func (b *builder) build() (*buildResult, error) {
 	if statusCode != 0 {
 		return nil, fmt.Errorf("build container finished with status code: %d", statusCode)
 	}
+	start = observePhase("build", start)
 
 	//save the cache for next build
 	b.logLine("-----> Saving cache for next build")
@@ -210,10 +419,18 @@ func (b *builder) build() (*buildResult, error) {
 	if err := b.client.DownloadFromContainer(container.ID, dlOpts); err != nil {
 		return nil, err
 	}
+	start = observePhase("cache_save", start)
 
 	//commit the container and upload the image, include a timestamp in the tag so it's ordered
-	tag := fmt.Sprintf("%d_%s", time.Now().Unix(), b.ref)
-	imgName := fmt.Sprintf("%s/%s", os.Getenv("IMAGE_NAMESPACE"), b.repo)
+	tags := b.release
+	if b.opts.Tag != "" {
+		tags = append([]string{b.opts.Tag}, tags...)
+	}
+	if len(tags) == 0 {
+		tags = []string{fmt.Sprintf("%d_%s_%s", time.Now().Unix(), tagComponent(b.branch), b.ref)}
+	}
+	tag := tags[0]
+	imgName := imageName(b.repo)
 	ciOpts := docker.CommitContainerOptions{
 		Container:  container.ID,
 		Repository: imgName,
@@ -236,20 +453,50 @@ func (b *builder) build() (*buildResult, error) {
 		}
 	}()
 
-	pushOpts := docker.PushImageOptions{
-		Name: imgName,
-		Tag:  tag,
+	//release aliases (e.g. v1.2, v1) point to the same image
+	for _, alias := range tags[1:] {
+		alias := alias
+		tagOpts := docker.TagImageOptions{
+			Repo:  imgName,
+			Tag:   alias,
+			Force: true,
+		}
+		if err := b.client.TagImage(fmt.Sprintf("%s:%s", imgName, tag), tagOpts); err != nil {
+			return nil, err
+		}
+		defer func() {
+			img := fmt.Sprintf("%s:%s", imgName, alias)
+			if err := b.client.RemoveImage(img); err != nil {
+				log.Errorf("unable to remove image %s: %v", img, err)
+			}
+		}()
 	}
+	start = observePhase("commit", start)
+
+	for _, t := range tags {
+		if ctx.Err() != nil {
+			return nil, errBuildCancelled
+		}
 
-	b.logLine(fmt.Sprintf("-----> Pushing image %s:%s to the registry (this may takes some times)", imgName, tag))
+		pushOpts := docker.PushImageOptions{
+			Context: ctx,
+			Name:    imgName,
+			Tag:     t,
+		}
 
-	if os.Getenv("DOCKPACK_ENV") == "testing" {
-		b.logLine(fmt.Sprintf("-----> Test, skipping push\r\n", imgName, tag))
-	} else {
-		if err := b.client.PushImage(pushOpts, pushAuthOpts); err != nil {
-			return nil, err
+		b.logLine(fmt.Sprintf("-----> Pushing image %s:%s to the registry (this may takes some times)", imgName, t))
+
+		if os.Getenv("DOCKPACK_ENV") == "testing" {
+			b.logLine(fmt.Sprintf("-----> Test, skipping push\r\n", imgName, t))
+		} else if b.opts.SkipPush {
+			b.logLine("-----> skip-push option set, skipping push")
+		} else {
+			if err := b.client.PushImage(pushOpts, pushAuthOpts); err != nil {
+				return nil, err
+			}
 		}
 	}
+	observePhase("push", start)
 
 	procfile, err := b.parseProcfile()
 	if err != nil {
@@ -258,13 +505,23 @@ func (b *builder) build() (*buildResult, error) {
 
 	fmt.Println(procfile)
 
-	return &buildResult{Repo: b.repo, ImageName: imgName, ImageTag: tag, Procfile: procfile}, nil
+	res := &buildResult{
+		Repo:         b.repo,
+		Branch:       b.branch,
+		ImageName:    imgName,
+		ImageTag:     tag,
+		ImageAliases: tags[1:],
+		Procfile:     procfile,
+	}
+	if len(b.release) > 0 {
+		res.Release = true
+		res.GitTag = b.release[0]
+	}
+	return res, nil
 }
 
 func (b *builder) parseProcfile() (map[string]string, error) {
-	procfile := filepath.Join("sandbox", fmt.Sprintf("%s_clone", b.repo), "Procfile")
-
-	file, err := os.Open(procfile)
+	file, err := b.src.procfile()
 	if err != nil {
 		return nil, err
 	}
@@ -276,6 +533,9 @@ func (b *builder) parseProcfile() (map[string]string, error) {
 		line := scanner.Text()
 		if len(line) > 0 {
 			comps := strings.SplitN(line, ":", 2)
+			if len(comps) != 2 {
+				return nil, fmt.Errorf("invalid Procfile line %q", line)
+			}
 			res[comps[0]] = comps[1]
 		}
 	}
@@ -286,3 +546,34 @@ func (b *builder) parseProcfile() (map[string]string, error) {
 func (b *builder) logLine(line string) {
 	b.writer.Write([]byte(line + "\r\n"))
 }
+
+//image repository of an app (IMAGE_NAMESPACE/app). The organization of an app is dropped unless
+//imageOrgSeparator is set (e.g. IMAGE_NAMESPACE/org-app)
+func imageName(repo string) string {
+	name := path.Base(repo)
+	if org := path.Dir(repo); org != "." && imageOrgSeparator != "" {
+		name = org + imageOrgSeparator + name
+	}
+	if ns := os.Getenv("IMAGE_NAMESPACE"); ns != "" {
+		return fmt.Sprintf("%s/%s", ns, name)
+	}
+	return name
+}
+
+//make s usable inside a docker image tag ([A-Za-z0-9_.-], 128 chars max)
+func tagComponent(s string) string {
+	const maxLen = 64
+	res := []rune{}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			res = append(res, r)
+		default:
+			res = append(res, '-')
+		}
+	}
+	if len(res) > maxLen {
+		res = res[:maxLen]
+	}
+	return string(res)
+}
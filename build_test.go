@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReleaseTags(t *testing.T) {
+	tests := []struct {
+		tag  string
+		tags []string
+	}{
+		{"v1.2.3", []string{"v1.2.3", "v1.2", "v1"}},
+		{"v10.0.12", []string{"v10.0.12", "v10.0", "v10"}},
+		{"v1.2.3-rc.1", []string{"v1.2.3-rc.1"}},
+		{"v1.2", nil},
+		{"1.2.3", nil},
+		{"v01.2.3", nil},
+		{"version-1", nil},
+	}
+
+	for _, test := range tests {
+		if res := releaseTags(test.tag, nil); !reflect.DeepEqual(res, test.tags) {
+			t.Errorf("releaseTags(%q) = %v, expected %v", test.tag, res, test.tags)
+		}
+	}
+}
+
+func TestReleaseTagsOutOfOrder(t *testing.T) {
+	released := []string{"v1.1.4", "v1.2.0", "v1.3.0-rc.1", "v2.0.0", "v10.0.0", "latest"}
+	tests := []struct {
+		tag  string
+		tags []string
+	}{
+		{"v1.1.5", []string{"v1.1.5", "v1.1"}},
+		{"v1.1.3", []string{"v1.1.3"}},
+		{"v1.2.1", []string{"v1.2.1", "v1.2", "v1"}},
+		{"v1.4.0", []string{"v1.4.0", "v1.4", "v1"}},
+		{"v2.0.0", []string{"v2.0.0", "v2.0", "v2"}}, //pushed again
+		{"v1.2.0-rc.2", []string{"v1.2.0-rc.2"}},
+	}
+
+	for _, test := range tests {
+		if res := releaseTags(test.tag, released); !reflect.DeepEqual(res, test.tags) {
+			t.Errorf("releaseTags(%q) = %v, expected %v", test.tag, res, test.tags)
+		}
+	}
+}
+
+func TestParsePushOptions(t *testing.T) {
+	opts, err := parsePushOptions([]string{"no-cache", "skip-push", "tag=staging-1", "env.FOO=bar=baz", "env.DEBUG="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &buildOptions{
+		NoCache:  true,
+		SkipPush: true,
+		Tag:      "staging-1",
+		Env:      []string{"FOO=bar=baz", "DEBUG="},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("got %#v, expected %#v", opts, expected)
+	}
+
+	for _, o := range []string{"foo", "tag=", "tag=-latest", "tag=a/b", "env.FOO", "env.1FOO=bar"} {
+		if _, err := parsePushOptions([]string{o}); err == nil {
+			t.Errorf("expected push option %q to be rejected", o)
+		}
+	}
+}
+
+func TestImageName(t *testing.T) {
+	defer os.Setenv("IMAGE_NAMESPACE", os.Getenv("IMAGE_NAMESPACE"))
+	defer func(sep string) { imageOrgSeparator = sep }(imageOrgSeparator)
+	os.Setenv("IMAGE_NAMESPACE", "company")
+
+	tests := []struct {
+		separator string
+		repo      string
+		image     string
+	}{
+		{"", "app", "company/app"},
+		{"", "acme/app", "company/app"},
+		{"-", "app", "company/app"},
+		{"-", "acme/app", "company/acme-app"},
+		{"/", "acme/app", "company/acme/app"},
+	}
+	for _, test := range tests {
+		imageOrgSeparator = test.separator
+		if image := imageName(test.repo); image != test.image {
+			t.Errorf("imageName(%q) with separator %q = %q, expected %q", test.repo, test.separator, image, test.image)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+//management command available through ssh (e.g: ssh -p 2222 dockpack.host builds my_app)
+type command struct {
+	usage       string
+	description string
+	nArgs       []int //accepted number of arguments
+	run         func(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	//initialized here as help references commands
+	commands = map[string]*command{
+		"help": {
+			usage:       "help",
+			description: "show this help",
+			nArgs:       []int{0},
+			run:         cmdHelp,
+		},
+		"apps": {
+			usage:       "apps",
+			description: "list apps",
+			nArgs:       []int{0},
+			run:         cmdApps,
+		},
+		"builds": {
+			usage:       "builds [app]",
+			description: "list recent builds",
+			nArgs:       []int{0, 1},
+			run:         cmdBuilds,
+		},
+		"logs": {
+			usage:       "logs <build_id>",
+			description: "show the logs of a build, follow them if the build is running",
+			nArgs:       []int{1},
+			run:         cmdLogs,
+		},
+		"cancel": {
+			usage:       "cancel <build_id>",
+			description: "cancel a running build",
+			nArgs:       []int{1},
+			run:         cmdCancel,
+		},
+		"delete": {
+			usage:       "delete <app>",
+			description: "delete an app git repository and build cache",
+			nArgs:       []int{1},
+			run:         cmdDelete,
+		},
+	}
+}
+
+func (s *server) handleCommand(ch ssh.Channel, args []string, authInfo map[string]string) error {
+	cmd := commands[args[0]]
+	args = args[1:]
+
+	ok := false
+	for _, n := range cmd.nArgs {
+		ok = ok || len(args) == n
+	}
+	if !ok {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+
+	log.Infof("receiving %s command with args %v", cmd.usage, args)
+	return cmd.run(s, ch, args, authInfo)
+}
+
+func cmdHelp(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(ch, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", commands[name].usage, commands[name].description)
+	}
+	return w.Flush()
+}
+
+func cmdApps(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	apps, err := s.listApps()
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		if s.canAccess(authInfo, app) {
+			fmt.Fprintln(ch, app)
+		}
+	}
+	return nil
+}
+
+func cmdBuilds(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	app := ""
+	if len(args) == 1 {
+		app = args[0]
+	}
+	if err := s.authorize(authInfo, app); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(ch, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAPP\tREF\tSTATUS\tQUEUED\tDURATION")
+	for _, rec := range s.visibleBuilds(authInfo, app, maxRecentBuilds) {
+		ref := rec.RefName
+		if len(rec.Ref) >= 7 {
+			ref = fmt.Sprintf("%s (%s)", rec.RefName, rec.Ref[:7])
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.ID, rec.Repo, ref, rec.Status, rec.queueTime().Format(time.RFC3339), rec.duration()/time.Second*time.Second)
+	}
+	return w.Flush()
+}
+
+func cmdLogs(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		return fmt.Errorf("build %s not found", args[0])
+	}
+	if err := s.authorize(authInfo, rec.Repo); err != nil {
+		return err
+	}
+	if err := registry.followLog(rec, ch); err != errNoLog {
+		return err
+	}
+	return fmt.Errorf("logs of build %s are not available", rec.ID)
+}
+
+func cmdCancel(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	rec, ok := registry.get(args[0])
+	if !ok {
+		return fmt.Errorf("build %s not found", args[0])
+	}
+	if err := s.authorize(authInfo, rec.Repo); err != nil {
+		return err
+	}
+	if err := registry.cancel(rec.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(ch, "build %s cancelled\n", rec.ID)
+	return nil
+}
+
+func cmdDelete(s *server, ch ssh.Channel, args []string, authInfo map[string]string) error {
+	app := args[0]
+	if !validAppName(app) {
+		return fmt.Errorf("invalid app name %q", app)
+	}
+	if err := s.authorize(authInfo, app); err != nil {
+		return err
+	}
+
+	apps, err := s.listApps()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, a := range apps {
+		found = found || a == app
+	}
+	if !found {
+		return fmt.Errorf("app %s not found", app)
+	}
+
+	if registry.running(app) {
+		return fmt.Errorf("app %s is being built, cancel the build first", app)
+	}
+	unlock, ok := locks.tryLock(app, "delete")
+	if !ok {
+		return fmt.Errorf("app %s is being built, try again later", app)
+	}
+	defer unlock()
+
+	//the lock file is removed with the repository
+	for _, path := range []string{
+		filepath.Join(s.workingDir, app),
+		filepath.Join(s.workingDir, fmt.Sprintf("%s_clone", app)),
+		filepath.Join(s.workingDir, fmt.Sprintf("%s_cache.tar", app)),
+		filepath.Join(s.workingDir, fmt.Sprintf("%s.log", app)),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	//remove the organization folder with its last app
+	if org := filepath.Dir(app); org != "." {
+		os.Remove(filepath.Join(s.workingDir, org)) //fails if not empty
+	}
+	fmt.Fprintf(ch, "app %s deleted\n", app)
+	return nil
+}
+
+//most recent builds of app (all apps if empty), without the builds of apps the user can't access
+func (s *server) visibleBuilds(authInfo map[string]string, app string, max int) []buildRecord {
+	access := map[string]bool{} //authorization may be slow (e.g. github), check each app once
+	return registry.history(max, func(repo string) bool {
+		if app != "" && repo != app {
+			return false
+		}
+		allowed, ok := access[repo]
+		if !ok {
+			allowed = s.canAccess(authInfo, repo)
+			access[repo] = allowed
+		}
+		return allowed
+	})
+}
+
+//apps are the bare git repositories of the sandbox (app or org/app), only the sandbox and the
+//organizations are walked: logs, clones and repositories are skipped
+func (s *server) listApps() ([]string, error) {
+	apps := []string{}
+	err := filepath.Walk(s.workingDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == s.workingDir {
+			return nil
+		}
+		app, err := filepath.Rel(s.workingDir, path)
+		if err != nil {
+			return err
+		}
+		if !validAppName(app) {
+			return filepath.SkipDir
+		}
+		if isBareRepo(path) {
+			apps = append(apps, app)
+			return filepath.SkipDir
+		}
+		if strings.Contains(app, "/") {
+			return filepath.SkipDir //organizations only hold apps
+		}
+		return nil
+	})
+	return apps, err
+}
+
+func isBareRepo(path string) bool {
+	for _, f := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(path, f)); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/robinmonjo/dockpack/auth"
+	"gopkg.in/src-d/go-git.v4"
+)
+
+const bobKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAII5NM0vzZipXwMYdW0QCOPCC5IXM1qKH/IR+Ed8VRcx3"
+
+//management commands output
+type testChannel struct {
+	bytes.Buffer
+}
+
+func (c *testChannel) Close() error      { return nil }
+func (c *testChannel) CloseWrite() error { return nil }
+func (c *testChannel) SendRequest(name string, wantReply bool, p []byte) (bool, error) {
+	return false, nil
+}
+func (c *testChannel) Stderr() io.ReadWriter { return &c.Buffer }
+
+//a server with the apps api and web, bob can only access api
+func newTestCommandServer(t *testing.T) (*server, func()) {
+	dir, err := ioutil.TempDir("", "dockpack-commands")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	for _, app := range []string{"api", "web"} {
+		if _, err := git.PlainInit(filepath.Join(dir, app), true); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	keys := filepath.Join(dir, "authorized_keys")
+	if err := ioutil.WriteFile(keys, []byte(`user="bob",repos="api" `+bobKey+"\n"), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	a, err := auth.NewFileAuth(keys)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return &server{workingDir: dir, authenticators: auth.Multi{a}}, cleanup
+}
+
+func TestListingsAreAuthorized(t *testing.T) {
+	s, cleanup := newTestCommandServer(t)
+	defer cleanup()
+	bob := map[string]string{"identity": "bob", "backend": "0"}
+
+	ch := &testChannel{}
+	if err := cmdApps(s, ch, nil, bob); err != nil {
+		t.Fatal(err)
+	}
+	if ch.String() != "api\n" {
+		t.Errorf("expected only api to be listed, got %q", ch.String())
+	}
+
+	for _, repo := range []string{"api", "web"} {
+		rec, _, _ := registry.start(context.Background(), &buildRequest{Repo: repo, Ref: "a1", RefName: "refs/heads/master", Pusher: "alice"})
+		registry.finish(rec, nil, nil)
+	}
+	builds := s.visibleBuilds(bob, "", maxRecentBuilds)
+	if len(builds) == 0 {
+		t.Error("expected the builds of api to be listed")
+	}
+	for _, rec := range builds {
+		if rec.Repo != "api" {
+			t.Errorf("unexpected build of %s listed", rec.Repo)
+		}
+	}
+
+	ch.Reset()
+	if err := cmdBuilds(s, ch, nil, bob); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ch.String(), "web") {
+		t.Errorf("unexpected builds of web listed:\n%s", ch.String())
+	}
+}
+
+func TestListApps(t *testing.T) {
+	s, cleanup := newTestCommandServer(t)
+	defer cleanup()
+	for _, dir := range []string{"acme/site", "logs/old", "api_clone/nested", "acme/site/nested"} {
+		if _, err := git.PlainInit(filepath.Join(s.workingDir, dir), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(s.workingDir, "acme/empty/deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	apps, err := s.listApps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(apps, ",") != "acme/site,api,web" {
+		t.Errorf("expected apps acme/site, api and web, got %v", apps)
+	}
+}
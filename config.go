@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+var (
+	configPath      = "sandbox/dockpack.json"
+	defaultBranches = []string{"master"}
+)
+
+func init() {
+	if p := os.Getenv("DOCKPACK_CONFIG"); p != "" {
+		configPath = p
+	}
+}
+
+//per repository settings
+type repoConfig struct {
+	Branches  []string `json:"branches,omitempty"`
+	Supersede *bool    `json:"supersede,omitempty"`
+	Async     *bool    `json:"async,omitempty"`
+}
+
+//dockpack configuration, loaded from a JSON file on each push so it can be edited without restarting
+type config struct {
+	Branches  []string               `json:"branches,omitempty"`
+	Supersede bool                   `json:"supersede,omitempty"`
+	Async     bool                   `json:"async,omitempty"`
+	Repos     map[string]*repoConfig `json:"repos,omitempty"`
+}
+
+func loadConfig() (*config, error) {
+	c := &config{}
+	f, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *config) repo(repo string) *repoConfig {
+	if rc, ok := c.Repos[repo]; ok && rc != nil {
+		return rc
+	}
+	return &repoConfig{}
+}
+
+//branch patterns triggering a build for the given repo
+func (c *config) branches(repo string) []string {
+	if b := c.repo(repo).Branches; len(b) > 0 {
+		return b
+	}
+	if len(c.Branches) > 0 {
+		return c.Branches
+	}
+	return defaultBranches
+}
+
+//check if a push on the given branch must be built, patterns use path.Match syntax (e.g. release/*)
+func (c *config) shouldBuild(repo, branch string) bool {
+	for _, pattern := range c.branches(repo) {
+		if ok, err := path.Match(pattern, branch); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+//check if a push must cancel the running build of the same branch
+func (c *config) supersede(repo string) bool {
+	if s := c.repo(repo).Supersede; s != nil {
+		return *s
+	}
+	return c.Supersede
+}
+
+//check if pushes are accepted at once and built in background
+func (c *config) async(repo string) bool {
+	if a := c.repo(repo).Async; a != nil {
+		return *a
+	}
+	return c.Async
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShouldBuild(t *testing.T) {
+	c := &config{
+		Repos: map[string]*repoConfig{
+			"app": {Branches: []string{"main", "release/*"}},
+		},
+	}
+
+	tests := []struct {
+		repo   string
+		branch string
+		build  bool
+	}{
+		{"other", "master", true},
+		{"other", "main", false},
+		{"app", "master", false},
+		{"app", "main", true},
+		{"app", "release/1.0", true},
+		{"app", "release/1.0/hotfix", false},
+	}
+
+	for _, test := range tests {
+		if res := c.shouldBuild(test.repo, test.branch); res != test.build {
+			t.Errorf("shouldBuild(%q, %q) = %v, expected %v", test.repo, test.branch, res, test.build)
+		}
+	}
+
+	//top level rules apply to repos without their own rules
+	c.Branches = []string{"*"}
+	if !c.shouldBuild("other", "staging") {
+		t.Errorf("expected top level rules to apply to repo other")
+	}
+	if c.shouldBuild("app", "staging") {
+		t.Errorf("expected repo rules to take precedence over top level rules")
+	}
+}
+
+func TestConfigSupersede(t *testing.T) {
+	no := false
+	c := &config{
+		Supersede: true,
+		Repos: map[string]*repoConfig{
+			"app": {Supersede: &no},
+		},
+	}
+	if !c.supersede("other") {
+		t.Errorf("expected top level supersede to apply to repo other")
+	}
+	if c.supersede("app") {
+		t.Errorf("expected repo supersede to take precedence over top level supersede")
+	}
+}
+
+func TestConfigAsync(t *testing.T) {
+	yes := true
+	c := &config{
+		Repos: map[string]*repoConfig{
+			"big_app": {Async: &yes},
+		},
+	}
+	if c.async("other") {
+		t.Errorf("expected builds to be synchronous by default")
+	}
+	if !c.async("big_app") {
+		t.Errorf("expected repo async to take precedence over top level async")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/robinmonjo/dockpack/auth"
+)
+
+const (
+	checkOK      = "ok"
+	checkFailing = "failing"
+)
+
+var (
+	minFreeSpace uint64 = 1024 //MB, the sandbox holds the repositories, build sources and caches
+	checkTimeout        = 5 * time.Second
+)
+
+func init() {
+	if space := os.Getenv("MIN_FREE_SPACE"); space != "" {
+		var err error
+		if minFreeSpace, err = strconv.ParseUint(space, 10, 64); err != nil {
+			panic(fmt.Sprintf("invalid MIN_FREE_SPACE: %q", space))
+		}
+	}
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*checkResult `json:"checks"`
+}
+
+//probes served without token on the API port
+var healthRoutes = map[string]func(a *apiServer) []healthCheck{
+	//failures dockpack can't recover from without a restart
+	"/healthz": func(a *apiServer) []healthCheck {
+		return []healthCheck{
+			{"host_key", a.s.checkHostKeys},
+			{"sandbox", a.s.checkSandbox},
+		}
+	},
+	//dockpack can build
+	"/readyz": func(a *apiServer) []healthCheck {
+		checks := []healthCheck{
+			{"host_key", a.s.checkHostKeys},
+			{"sandbox", a.s.checkSandbox},
+			{"disk_space", a.s.checkFreeSpace},
+			{"docker", checkDocker},
+		}
+		if gh := githubAuth(a.s.authenticators); gh != nil {
+			checks = append(checks, healthCheck{"github", func(ctx context.Context) error { return gh.CheckToken() }})
+		}
+		return checks
+	},
+}
+
+func serveHealth(w http.ResponseWriter, checks []healthCheck) {
+	report := runHealthChecks(checks)
+	status := http.StatusOK
+	if report.Status != checkOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeAPIResponse(w, status, report)
+}
+
+//checks are run concurrently, a check not done within checkTimeout is failing
+func runHealthChecks(checks []healthCheck) *healthReport {
+	type done struct {
+		name string
+		err  error
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	results := make(chan done, len(checks))
+	for _, c := range checks {
+		c := c
+		go func() {
+			results <- done{c.name, c.check(ctx)}
+		}()
+	}
+
+	report := &healthReport{Status: checkOK, Checks: map[string]*checkResult{}}
+	for _, c := range checks {
+		report.Checks[c.name] = &checkResult{Status: checkFailing, Error: "timed out"}
+	}
+	for range checks {
+		select {
+		case d := <-results:
+			report.Checks[d.name] = &checkResult{Status: checkOK}
+			if d.err != nil {
+				report.Checks[d.name] = &checkResult{Status: checkFailing, Error: d.err.Error()}
+			}
+		case <-ctx.Done():
+		}
+	}
+	for _, r := range report.Checks {
+		if r.Status != checkOK {
+			report.Status = checkFailing
+		}
+	}
+	return report
+}
+
+func (s *server) checkHostKeys(ctx context.Context) error {
+	if len(s.hostKeys) == 0 {
+		return fmt.Errorf("no host key loaded")
+	}
+	return nil
+}
+
+//the sandbox must be writable
+func (s *server) checkSandbox(ctx context.Context) error {
+	f, err := ioutil.TempFile(s.workingDir, ".healthcheck")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+//the sandbox must have at least minFreeSpace MB available, dockpack recovers once space is freed
+func (s *server) checkFreeSpace(ctx context.Context) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.workingDir, &st); err != nil {
+		return err
+	}
+	if free := st.Bavail * uint64(st.Bsize) / (1 << 20); free < minFreeSpace {
+		return fmt.Errorf("%d MB available, %d MB required", free, minFreeSpace)
+	}
+	return nil
+}
+
+//the docker daemon used by the builds responds
+func checkDocker(ctx context.Context) error {
+	client, err := docker.NewClient(endpoint)
+	if err != nil {
+		return err
+	}
+	return client.PingWithContext(ctx)
+}
+
+//github authentication backend, nil if not enabled
+func githubAuth(authenticators auth.Multi) *auth.GithubAuth {
+	for _, a := range authenticators {
+		if gh, ok := a.(*auth.GithubAuth); ok {
+			return gh
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	defer func(timeout time.Duration) { checkTimeout = timeout }(checkTimeout)
+	checkTimeout = 100 * time.Millisecond
+
+	report := runHealthChecks([]healthCheck{
+		{"ok", func(ctx context.Context) error { return nil }},
+		{"ko", func(ctx context.Context) error { return errors.New("broken") }},
+		{"slow", func(ctx context.Context) error { time.Sleep(time.Second); return nil }},
+	})
+	if report.Status != checkFailing {
+		t.Errorf("expected failing report, got %s", report.Status)
+	}
+	expected := map[string]checkResult{
+		"ok":   {Status: checkOK},
+		"ko":   {Status: checkFailing, Error: "broken"},
+		"slow": {Status: checkFailing, Error: "timed out"},
+	}
+	for name, r := range expected {
+		if report.Checks[name] == nil || *report.Checks[name] != r {
+			t.Errorf("%s: expected %#v, got %#v", name, r, report.Checks[name])
+		}
+	}
+
+	if report := runHealthChecks([]healthCheck{{"ok", func(ctx context.Context) error { return nil }}}); report.Status != checkOK {
+		t.Errorf("expected ok report, got %s", report.Status)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	defer func(space uint64) { minFreeSpace = space }(minFreeSpace)
+	minFreeSpace = 0
+
+	a, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	//probes don't need the token, the test server has no host key
+	w := apiRequest(a, "GET", "/healthz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	var report healthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if r := report.Checks["sandbox"]; r == nil || r.Status != checkOK {
+		t.Errorf("expected sandbox check ok, got %#v", r)
+	}
+	if r := report.Checks["host_key"]; r == nil || r.Status != checkFailing {
+		t.Errorf("expected host key check failing, got %#v", r)
+	}
+
+	//lack of free space only makes dockpack unready
+	minFreeSpace = 1 << 40
+	w = apiRequest(a, "GET", "/healthz", "")
+	report = healthReport{}
+	json.NewDecoder(w.Body).Decode(&report)
+	if r := report.Checks["sandbox"]; r == nil || r.Status != checkOK {
+		t.Errorf("expected sandbox check ok without free space, got %#v", r)
+	}
+	if _, ok := report.Checks["disk_space"]; ok {
+		t.Errorf("unexpected disk space check in liveness probe")
+	}
+	w = apiRequest(a, "GET", "/readyz", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	report = healthReport{}
+	json.NewDecoder(w.Body).Decode(&report)
+	if r := report.Checks["disk_space"]; r == nil || r.Status != checkFailing {
+		t.Errorf("expected disk space check failing without free space, got %#v", r)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	hookSocketName     = "dockpack.sock"
+	buildResultTrailer = "Dockpack-Build-Result"
+
+	zeroRef = "0000000000000000000000000000000000000000"
+)
+
+//terminal status of a build request, sent as JSON in the build result trailer once the output is streamed
+type buildOutcome struct {
+	BuildID string      `json:"build_id,omitempty"`
+	Status  buildStatus `json:"status"`
+	Error   string      `json:"error,omitempty"`
+}
+
+//outcome of the build started for a ref (nil if the ref wasn't built). An async push only queues the build,
+//the build may already be running or even finished when the outcome is sent
+func newBuildOutcome(rec *buildRecord, err error, async bool) *buildOutcome {
+	if rec != nil && err == nil && async {
+		return &buildOutcome{BuildID: rec.ID, Status: statusQueued}
+	}
+	if rec != nil {
+		if b, ok := registry.get(rec.ID); ok {
+			return &buildOutcome{BuildID: b.ID, Status: b.Status, Error: b.Error}
+		}
+	}
+	if err != nil {
+		o := &buildOutcome{Status: statusFailed, Error: err.Error()}
+		if rec != nil {
+			o.BuildID = rec.ID
+		}
+		return o
+	}
+	return &buildOutcome{Status: statusSkipped}
+}
+
+//check if the push can be accepted, async builds are accepted once queued
+func (o *buildOutcome) accepted() bool {
+	return o.Status == statusSucceeded || o.Status == statusSkipped || o.Status == statusQueued
+}
+
+//hooks of the exec git backend, run by git-receive-pack for each push:
+//
+//	dockpack hook pre-receive|post-receive --repo <app> --sandbox <dir>
+//
+//each pushed ref is sent to the dockpack server through its unix socket. The pre-receive hook waits for the builds
+//and rejects the push if one fails, the post-receive hook (async repos) only queues them
+type receiveHook struct {
+	repo    string
+	sandbox string
+	async   bool
+	pusher  string
+	client  *http.Client
+	archive func(ref, path string) error //extract the sources of ref in a tar archive
+}
+
+func hookCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "pre-receive" && args[0] != "post-receive") {
+		return fmt.Errorf("usage: dockpack hook pre-receive|post-receive --repo <app> --sandbox <dir>")
+	}
+
+	flags := flag.NewFlagSet("hook "+args[0], flag.ContinueOnError)
+	repo := flags.String("repo", "", "app receiving the push")
+	sandbox := flags.String("sandbox", "sandbox", "dockpack sandbox folder")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *repo == "" {
+		return fmt.Errorf("missing --repo")
+	}
+
+	h := newReceiveHook(*repo, *sandbox, args[0] == "post-receive")
+	h.pusher = os.Getenv("DOCKPACK_PUSHER") //set by dockpack for git-receive-pack
+	return h.run(os.Stdin, os.Stdout, gitPushOptions())
+}
+
+func newReceiveHook(repo, sandbox string, async bool) *receiveHook {
+	socket := filepath.Join(sandbox, hookSocketName)
+	return &receiveHook{
+		repo:    repo,
+		sandbox: sandbox,
+		async:   async,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		archive: gitArchive,
+	}
+}
+
+//git runs the hook from the repository, pre-receive hooks get the pushed objects in quarantine (available through the env)
+func gitArchive(ref, path string) error {
+	out, err := exec.Command("git", "archive", "-o", path, ref).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git archive failed: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+//push options (git push -o) are given to the hook through the env
+func gitPushOptions() []string {
+	count, _ := strconv.Atoi(os.Getenv("GIT_PUSH_OPTION_COUNT"))
+	opts := []string{}
+	for i := 0; i < count; i++ {
+		opts = append(opts, os.Getenv(fmt.Sprintf("GIT_PUSH_OPTION_%d", i)))
+	}
+	return opts
+}
+
+//read the pushed refs ("<old> <new> <ref_name>" lines) and build them one by one
+func (h *receiveHook) run(stdin io.Reader, stdout io.Writer, pushOptions []string) error {
+	failed := []string{} //refs of async pushes that couldn't be queued
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected hook input %q", scanner.Text())
+		}
+		newRef, refName := fields[1], fields[2]
+
+		//ref deletion, nothing to build
+		if newRef == zeroRef {
+			continue
+		}
+		if !strings.HasPrefix(refName, "refs/heads/") && !strings.HasPrefix(refName, "refs/tags/v") {
+			continue
+		}
+
+		req := &buildRequest{Repo: h.repo, Ref: newRef, RefName: refName, PushOptions: pushOptions, Async: h.async, Pusher: h.pusher}
+		if err := h.build(req, stdout); err != nil {
+			//refs are already updated after a post-receive hook, the other refs must still be queued
+			if !h.async {
+				return err
+			}
+			fmt.Fprintln(stdout, err)
+			failed = append(failed, refName)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unable to queue the build of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (h *receiveHook) build(req *buildRequest, stdout io.Writer) error {
+	archive := filepath.Join(h.sandbox, fmt.Sprintf("%s_%s.tar", req.Repo, req.Ref))
+	if err := h.archive(req.Ref, archive); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("PUT", "http://dockpack/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("unable to reach dockpack: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to build %s: %s", req.RefName, resp.Status)
+	}
+
+	//build logs are kept by the server (see the logs command)
+	if _, err := io.Copy(stdout, resp.Body); err != nil {
+		return fmt.Errorf("build of %s interrupted: %v", req.RefName, err)
+	}
+	return checkBuildResult(req, resp)
+}
+
+//the trailer is only available once the body has been read, without it the build is considered failed
+//(e.g. dockpack stopped during the build)
+func checkBuildResult(req *buildRequest, resp *http.Response) error {
+	var o buildOutcome
+	if err := json.Unmarshal([]byte(resp.Trailer.Get(buildResultTrailer)), &o); err != nil {
+		return fmt.Errorf("no build result received for %s", req.RefName)
+	}
+	switch {
+	case o.accepted():
+		return nil
+	case o.BuildID == "":
+		return fmt.Errorf("%s rejected: %s", req.RefName, o.Error)
+	}
+	return fmt.Errorf("build %s of %s %s", o.BuildID, req.RefName, o.Status)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//start a fake dockpack server on the hook socket of a temporary sandbox
+func newTestHook(t *testing.T, handler http.HandlerFunc) (*receiveHook, func()) {
+	sandbox, err := ioutil.TempDir("", "dockpack-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenHookSocket(filepath.Join(sandbox, hookSocketName))
+	if err != nil {
+		os.RemoveAll(sandbox)
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+
+	h := newReceiveHook("app", sandbox, false)
+	h.archive = func(ref, path string) error {
+		return ioutil.WriteFile(path, []byte(ref), 0644)
+	}
+	return h, func() {
+		srv.Close()
+		os.RemoveAll(sandbox)
+	}
+}
+
+func TestPreReceiveHook(t *testing.T) {
+	builds := []buildRequest{}
+	h, cleanup := newTestHook(t, func(w http.ResponseWriter, r *http.Request) {
+		var req buildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		builds = append(builds, req)
+
+		w.Header().Set("Trailer", buildResultTrailer)
+		fmt.Fprintf(w, "building %s\n", req.RefName)
+		if req.RefName == "refs/heads/broken" {
+			w.Header().Set(buildResultTrailer, `{"build_id": "b1", "status": "failed", "error": "boom"}`)
+			return
+		}
+		w.Header().Set(buildResultTrailer, `{"build_id": "b2", "status": "succeeded"}`)
+	})
+	defer cleanup()
+
+	ref := strings.Repeat("a", 40)
+	stdin := strings.Join([]string{
+		zeroRef + " " + ref + " refs/heads/master",
+		ref + " " + zeroRef + " refs/heads/deleted",
+		zeroRef + " " + ref + " refs/tags/not-a-release",
+		zeroRef + " " + ref + " refs/notes/commits",
+		zeroRef + " " + ref + " refs/tags/v1.0.0",
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := h.run(strings.NewReader(stdin), &out, []string{"no-cache"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(builds) != 2 || builds[0].RefName != "refs/heads/master" || builds[1].RefName != "refs/tags/v1.0.0" {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+	if builds[0].Repo != "app" || builds[0].Ref != ref || len(builds[0].PushOptions) != 1 || builds[0].PushOptions[0] != "no-cache" {
+		t.Errorf("unexpected build request %#v", builds[0])
+	}
+	if expected := "building refs/heads/master\nbuilding refs/tags/v1.0.0\n"; out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+
+	//sources are extracted for the server
+	if _, err := os.Stat(filepath.Join(h.sandbox, fmt.Sprintf("app_%s.tar", ref))); err != nil {
+		t.Errorf("expected sources archive: %v", err)
+	}
+
+	//a failed build rejects the push
+	builds = builds[:0]
+	stdin = zeroRef + " " + ref + " refs/heads/broken\n" + zeroRef + " " + ref + " refs/heads/master"
+	err := h.run(strings.NewReader(stdin), ioutil.Discard, nil)
+	if err == nil || err.Error() != "build b1 of refs/heads/broken failed" {
+		t.Errorf("expected failed build to reject the push, got %v", err)
+	}
+	if len(builds) != 1 {
+		t.Errorf("expected refs after a failed build to be skipped, got %v", builds)
+	}
+}
+
+func TestPostReceiveHook(t *testing.T) {
+	var async bool
+	h, cleanup := newTestHook(t, func(w http.ResponseWriter, r *http.Request) {
+		var req buildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		async = req.Async
+		w.Header().Set("Trailer", buildResultTrailer)
+		fmt.Fprintln(w, "build queued")
+		w.Header().Set(buildResultTrailer, `{"build_id": "b3", "status": "queued"}`)
+	})
+	defer cleanup()
+	h.async = true
+
+	stdin := zeroRef + " " + strings.Repeat("a", 40) + " refs/heads/master"
+	var out bytes.Buffer
+	if err := h.run(strings.NewReader(stdin), &out, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !async {
+		t.Errorf("expected an async build request")
+	}
+	if out.String() != "build queued\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestPreReceiveHookMissingResult(t *testing.T) {
+	//the server died during the build
+	h, cleanup := newTestHook(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "building")
+	})
+	defer cleanup()
+
+	stdin := zeroRef + " " + strings.Repeat("a", 40) + " refs/heads/master"
+	if err := h.run(strings.NewReader(stdin), ioutil.Discard, nil); err == nil {
+		t.Errorf("expected an error without build result")
+	}
+}
+
+func TestPreReceiveHookNoServer(t *testing.T) {
+	h := newReceiveHook("app", "/nonexistent", false)
+	h.archive = func(ref, path string) error { return nil }
+
+	stdin := zeroRef + " " + strings.Repeat("a", 40) + " refs/heads/master"
+	err := h.run(strings.NewReader(stdin), ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "unable to reach dockpack") {
+		t.Errorf("expected connection error, got %v", err)
+	}
+}
+
+func TestBuildOutcome(t *testing.T) {
+	if o := newBuildOutcome(nil, nil, false); o.Status != statusSkipped || !o.accepted() {
+		t.Errorf("expected skipped ref to be accepted, got %#v", o)
+	}
+	if o := newBuildOutcome(nil, fmt.Errorf("unknown push option"), false); o.Status != statusFailed || o.accepted() {
+		t.Errorf("expected invalid push to be rejected, got %#v", o)
+	}
+
+	rec, _, _ := registry.start(context.Background(), &buildRequest{Repo: "app", Ref: "ref", RefName: "refs/heads/master"})
+	if o := newBuildOutcome(rec, nil, false); o.BuildID != rec.ID || o.Status != statusQueued || !o.accepted() {
+		t.Errorf("expected queued build to be accepted, got %#v", o)
+	}
+	err := fmt.Errorf("boom")
+	registry.finish(rec, nil, err)
+	if o := newBuildOutcome(rec, err, false); o.BuildID != rec.ID || o.Status != statusFailed || o.Error != "boom" || o.accepted() {
+		t.Errorf("expected failed build to be rejected, got %#v", o)
+	}
+}
+
+func TestAsyncBuildOutcome(t *testing.T) {
+	//the build got a slot before the trailer is written
+	rec, _, _ := registry.start(context.Background(), &buildRequest{Repo: "app", Ref: "ref", RefName: "refs/heads/master", Async: true})
+	registry.run(rec)
+	if o := newBuildOutcome(rec, nil, true); o.BuildID != rec.ID || o.Status != statusQueued || !o.accepted() {
+		t.Errorf("expected running async build to be accepted, got %#v", o)
+	}
+	if o := newBuildOutcome(rec, nil, false); o.Status != statusRunning || o.accepted() {
+		t.Errorf("expected unfinished sync build to be rejected, got %#v", o)
+	}
+
+	//the build already failed
+	registry.finish(rec, nil, fmt.Errorf("boom"))
+	if o := newBuildOutcome(rec, nil, true); o.Status != statusQueued || !o.accepted() {
+		t.Errorf("expected failed async build to be accepted, got %#v", o)
+	}
+
+	//the build couldn't be queued
+	if o := newBuildOutcome(nil, fmt.Errorf("unknown push option"), true); o.Status != statusFailed || o.accepted() {
+		t.Errorf("expected invalid async push to be rejected, got %#v", o)
+	}
+}
+
+func TestPostReceiveHookQueuesAllRefs(t *testing.T) {
+	queued := []string{}
+	h, cleanup := newTestHook(t, func(w http.ResponseWriter, r *http.Request) {
+		var req buildRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Trailer", buildResultTrailer)
+		if req.RefName == "refs/heads/broken" {
+			w.Header().Set(buildResultTrailer, `{"status": "failed", "error": "unknown push option"}`)
+			return
+		}
+		queued = append(queued, req.RefName)
+		w.Header().Set(buildResultTrailer, `{"build_id": "b4", "status": "queued"}`)
+	})
+	defer cleanup()
+	h.async = true
+
+	sha := strings.Repeat("a", 40)
+	stdin := zeroRef + " " + sha + " refs/heads/broken\n" + zeroRef + " " + sha + " refs/heads/master\n"
+	if err := h.run(strings.NewReader(stdin), ioutil.Discard, nil); err == nil || !strings.Contains(err.Error(), "refs/heads/broken") {
+		t.Errorf("expected an error for refs/heads/broken, got %v", err)
+	}
+	if len(queued) != 1 || queued[0] != "refs/heads/master" {
+		t.Errorf("expected refs/heads/master to be queued, got %v", queued)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	hostKeysDir       = "sandbox/host_keys"
+	hostKeyTypes      = []string{"ed25519", "ecdsa", "rsa"}
+	legacyHostKeyPath = "./id_rsa" //rsa host key of previous versions
+)
+
+func init() {
+	if dir := os.Getenv("HOST_KEYS_DIR"); dir != "" {
+		hostKeysDir = dir
+	}
+}
+
+func hostKeyPath(keyType string) string {
+	return filepath.Join(hostKeysDir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+func generateHostKey(keyType string) (interface{}, error) {
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("unsupported host key type %q", keyType)
+}
+
+//write the key PEM encoded (PKCS8), the file is replaced atomically
+func writeHostKey(path string, key interface{}) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//load the host keys from the sandbox, missing ones are generated
+func loadHostKeys() ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	for _, keyType := range hostKeyTypes {
+		path := hostKeyPath(keyType)
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := createHostKey(keyType, path); err != nil {
+				return nil, err
+			}
+		}
+
+		pkBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pkBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host key %s: %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func createHostKey(keyType, path string) error {
+	//keep the rsa key of older versions so clients known_hosts stay valid
+	if keyType == "rsa" {
+		if pkBytes, err := ioutil.ReadFile(legacyHostKeyPath); err == nil {
+			log.Infof("using %s as rsa host key", legacyHostKeyPath)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(path, pkBytes, 0600)
+		}
+	}
+
+	log.Infof("generating %s host key", keyType)
+	key, err := generateHostKey(keyType)
+	if err != nil {
+		return err
+	}
+	return writeHostKey(path, key)
+}
+
+//generate new host keys, they are used on next start
+func rotateHostKeys(w io.Writer) error {
+	for _, keyType := range hostKeyTypes {
+		key, err := generateHostKey(keyType)
+		if err != nil {
+			return err
+		}
+		if err := writeHostKey(hostKeyPath(keyType), key); err != nil {
+			return err
+		}
+	}
+	if err := printHostKeys(w); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "restart dockpack to use the new host keys")
+	return nil
+}
+
+func printHostKeys(w io.Writer) error {
+	signers, err := loadHostKeys()
+	if err != nil {
+		return err
+	}
+	for _, signer := range signers {
+		fmt.Fprintf(w, "%s %s\n", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	return nil
+}
+
+//dockpack hostkey [show|rotate]
+func hostKeyCommand(args []string) error {
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+
+	switch args[0] {
+	case "show":
+		return printHostKeys(os.Stdout)
+	case "rotate":
+		return rotateHostKeys(os.Stdout)
+	}
+	return fmt.Errorf("usage: dockpack hostkey [show|rotate]")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//fingerprints of the host keys by type
+func hostKeyFingerprints(t *testing.T) map[string]string {
+	signers, err := loadHostKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprints := map[string]string{}
+	for _, signer := range signers {
+		fingerprints[signer.PublicKey().Type()] = ssh.FingerprintSHA256(signer.PublicKey())
+	}
+	return fingerprints
+}
+
+func TestHostKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockpack-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir, legacy string) { hostKeysDir, legacyHostKeyPath = dir, legacy }(hostKeysDir, legacyHostKeyPath)
+	hostKeysDir = filepath.Join(dir, "host_keys")
+	legacyHostKeyPath = filepath.Join(dir, "id_rsa")
+
+	//rsa key of a previous version (PKCS1)
+	legacyKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(legacyKey)})
+	if err := ioutil.WriteFile(legacyHostKeyPath, legacyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	legacySigner, err := ssh.ParsePrivateKey(legacyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated := hostKeyFingerprints(t)
+	for _, keyType := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSA} {
+		if generated[keyType] == "" {
+			t.Errorf("no %s host key generated", keyType)
+		}
+	}
+	if fp := ssh.FingerprintSHA256(legacySigner.PublicKey()); generated[ssh.KeyAlgoRSA] != fp {
+		t.Errorf("expected the legacy rsa key %s to be used, got %s", fp, generated[ssh.KeyAlgoRSA])
+	}
+	for _, keyType := range hostKeyTypes {
+		info, err := os.Stat(hostKeyPath(keyType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected mode 0600, got %v", keyType, info.Mode().Perm())
+		}
+	}
+
+	//persisted keys are reloaded
+	for keyType, fp := range hostKeyFingerprints(t) {
+		if generated[keyType] != fp {
+			t.Errorf("%s: host key changed on reload, %s != %s", keyType, generated[keyType], fp)
+		}
+	}
+
+	if err := rotateHostKeys(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	rotated := hostKeyFingerprints(t)
+	for keyType, fp := range generated {
+		if rotated[keyType] == "" || rotated[keyType] == fp {
+			t.Errorf("%s: host key not rotated", keyType)
+		}
+	}
+}
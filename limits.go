@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	maxConnections   = 100              //concurrent ssh connections
+	handshakeTimeout = 30 * time.Second //time given to clients to authenticate
+	idleTimeout      = 10 * time.Minute //connections without any traffic are closed
+	connRateLimit    = 30               //new connections per minute and per source ip
+)
+
+func init() {
+	for env, v := range map[string]*int{"MAX_CONNECTIONS": &maxConnections, "CONN_RATE_LIMIT": &connRateLimit} {
+		if s := os.Getenv(env); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				panic(fmt.Sprintf("invalid %s: %q", env, s))
+			}
+			*v = n
+		}
+	}
+	for env, v := range map[string]*time.Duration{"HANDSHAKE_TIMEOUT": &handshakeTimeout, "IDLE_TIMEOUT": &idleTimeout} {
+		if s := os.Getenv(env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				panic(fmt.Sprintf("invalid %s: %q", env, s))
+			}
+			*v = d
+		}
+	}
+}
+
+//connection whose deadline is pushed back on each read or write once the idle timeout is set
+type idleConn struct {
+	net.Conn
+	timeout int64 //time.Duration, accessed atomically
+}
+
+func (c *idleConn) setIdleTimeout(d time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(d))
+	c.Conn.SetDeadline(time.Now().Add(d))
+}
+
+func (c *idleConn) extendDeadline() {
+	if d := time.Duration(atomic.LoadInt64(&c.timeout)); d > 0 {
+		c.Conn.SetDeadline(time.Now().Add(d))
+	}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.extendDeadline()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.extendDeadline()
+	}
+	return n, err
+}
+
+//send keepalive requests to the client every interval until stop is called, its replies keep the
+//connection from being idle. A client that doesn't reply is still disconnected by the idle timeout
+func keepAlive(conn ssh.Conn, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, _, err := conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+//token bucket per source ip: rate tokens per minute, with a burst of rate tokens
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+	pruned  time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+//take a token from the bucket of ip, returns false if it's empty
+func (l *rateLimiter) allow(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+
+	//forget about ips whose bucket is full again
+	if now.Sub(l.pruned) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("connection %d should be allowed", i)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatal("burst exceeded, connection should be refused")
+	}
+	if !l.allow("10.0.0.2") {
+		t.Fatal("other ips must not be limited")
+	}
+
+	//one token every 20 seconds
+	now = now.Add(20 * time.Second)
+	if !l.allow("10.0.0.1") {
+		t.Fatal("connection should be allowed after refill")
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatal("only one token should have been refilled")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1") {
+			t.Fatalf("connection %d should be allowed after a full refill", i)
+		}
+	}
+	if l.allow("10.0.0.1") {
+		t.Fatal("bucket must not exceed the burst")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	key, err := generateHostKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	stopc := make(chan func(), 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := &idleConn{Conn: c}
+		defer conn.Close()
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		conn.setIdleTimeout(300 * time.Millisecond)
+		go ssh.DiscardRequests(reqs)
+		stopc <- keepAlive(sshConn, 50*time.Millisecond)
+		for range chans {
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{User: "git", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	stop := <-stopc
+
+	//the client doesn't send anything but its replies to the keepalives
+	time.Sleep(time.Second)
+	if _, _, err := client.SendRequest("ping", true, nil); err != nil {
+		t.Fatalf("connection closed despite keepalives: %v", err)
+	}
+
+	stop()
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed once keepalives are stopped")
+	}
+}
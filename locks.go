@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const lockFile = ".dockpack_lock"
+
+var (
+	//progress messages are written at this interval while waiting for a lock
+	lockProgressInterval = 10 * time.Second
+
+	locks = newLockManager("sandbox")
+)
+
+//owner of a repo lock, written in the repo lock file
+type lockOwner struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Holder    string    `json:"holder"` //what holds the lock (e.g. push from alice)
+	StartedAt time.Time `json:"started_at"`
+}
+
+func newLockOwner(holder string) lockOwner {
+	hostname, _ := os.Hostname()
+	return lockOwner{
+		PID:       os.Getpid(),
+		Hostname:  hostname,
+		Holder:    holder,
+		StartedAt: time.Now(),
+	}
+}
+
+//a lock file is stale if the process that wrote it is gone
+func (o *lockOwner) stale() bool {
+	hostname, _ := os.Hostname()
+	if o.Hostname != hostname || o.PID == os.Getpid() {
+		//written by another container or by a previous process that had our pid
+		return true
+	}
+	return syscall.Kill(o.PID, 0) == syscall.ESRCH
+}
+
+type lockWaiter struct {
+	owner lockOwner
+	ready chan struct{} //closed when the lock is handed over
+}
+
+type repoLock struct {
+	held    bool
+	owner   lockOwner
+	waiters []*lockWaiter //first in first served
+}
+
+//serialize builds of a repository, the owner of the lock is recorded in a lock file in the repository
+type lockManager struct {
+	sync.Mutex
+	workingDir string
+	locks      map[string]*repoLock
+}
+
+func newLockManager(workingDir string) *lockManager {
+	return &lockManager{
+		workingDir: workingDir,
+		locks:      map[string]*repoLock{},
+	}
+}
+
+func (m *lockManager) lockFilePath(repo string) string {
+	return filepath.Join(m.workingDir, repo, lockFile)
+}
+
+//must be called with m locked
+func (m *lockManager) repoLock(repo string) *repoLock {
+	l, ok := m.locks[repo]
+	if !ok {
+		l = &repoLock{}
+		m.locks[repo] = l
+	}
+	return l
+}
+
+//must be called with m locked
+func (m *lockManager) take(repo string, l *repoLock, owner lockOwner) {
+	l.held = true
+	l.owner = owner
+	data, _ := json.Marshal(owner)
+	if err := ioutil.WriteFile(m.lockFilePath(repo), data, 0644); err != nil {
+		log.Errorf("unable to write lock file of %s: %v", repo, err)
+	}
+}
+
+//lock repo, waiting for the current holder if any. Progress messages are written to w while waiting,
+//waiting is given up if they can't be written (client gone) or if ctx is done
+func (m *lockManager) lock(ctx context.Context, repo, holder string, w io.Writer) (func(), error) {
+	m.Lock()
+	l := m.repoLock(repo)
+	if !l.held {
+		m.take(repo, l, newLockOwner(holder))
+		m.Unlock()
+		return func() { m.unlock(repo) }, nil
+	}
+	waiter := &lockWaiter{owner: newLockOwner(holder), ready: make(chan struct{})}
+	l.waiters = append(l.waiters, waiter)
+	owner, position := l.owner, len(l.waiters)
+	m.Unlock()
+
+	fmt.Fprintf(w, "%s is locked by %s since %s, waiting (position %d in queue)\n", repo, owner.Holder, owner.StartedAt.Format("15:04:05"), position)
+	ticker := time.NewTicker(lockProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-waiter.ready:
+			fmt.Fprintf(w, "%s unlocked\n", repo)
+			return func() { m.unlock(repo) }, nil
+		case <-ticker.C:
+			m.Lock()
+			owner, position = l.owner, l.position(waiter)
+			m.Unlock()
+			if position == 0 {
+				continue //being handed over
+			}
+			_, err := fmt.Fprintf(w, "still waiting for %s started at %s (position %d in queue)\n", owner.Holder, owner.StartedAt.Format("15:04:05"), position)
+			if err != nil {
+				m.cancel(repo, l, waiter)
+				return nil, err
+			}
+		case <-ctx.Done():
+			m.cancel(repo, l, waiter)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//lock repo only if it's not locked
+func (m *lockManager) tryLock(repo, holder string) (func(), bool) {
+	m.Lock()
+	defer m.Unlock()
+	l := m.repoLock(repo)
+	if l.held {
+		return nil, false
+	}
+	m.take(repo, l, newLockOwner(holder))
+	return func() { m.unlock(repo) }, true
+}
+
+//1 based position of w in the queue, 0 if not queued
+func (l *repoLock) position(w *lockWaiter) int {
+	for i, waiter := range l.waiters {
+		if waiter == w {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+//stop waiting, if the lock was handed over meanwhile it's released
+func (m *lockManager) cancel(repo string, l *repoLock, w *lockWaiter) {
+	m.Lock()
+	i := l.position(w)
+	if i > 0 {
+		l.waiters = append(l.waiters[:i-1], l.waiters[i:]...)
+	}
+	m.Unlock()
+	if i == 0 {
+		m.unlock(repo)
+	}
+}
+
+//release the lock of repo, handing it over to the first waiter
+func (m *lockManager) unlock(repo string) {
+	m.Lock()
+	defer m.Unlock()
+	l := m.repoLock(repo)
+	if len(l.waiters) == 0 {
+		l.held = false
+		if err := os.RemoveAll(m.lockFilePath(repo)); err != nil {
+			log.Errorf("unable to remove lock file of %s: %v", repo, err)
+		}
+		delete(m.locks, repo)
+		return
+	}
+	next := l.waiters[0]
+	l.waiters = l.waiters[1:]
+	m.take(repo, l, next.owner)
+	close(next.ready)
+}
+
+//remove lock files left by processes that are gone (e.g. crash during a build)
+func (m *lockManager) clearStaleLocks(repos []string) {
+	for _, repo := range repos {
+		data, err := ioutil.ReadFile(m.lockFilePath(repo))
+		if os.IsNotExist(err) {
+			continue
+		}
+		owner := lockOwner{}
+		if err == nil {
+			err = json.Unmarshal(data, &owner) //lock files of previous versions are empty
+		}
+		if err == nil && !owner.stale() {
+			log.Warnf("%s is locked by %s (pid %d) since %s", repo, owner.Holder, owner.PID, owner.StartedAt)
+			continue
+		}
+		log.Infof("removing stale lock of %s (pid %d, started at %s)", repo, owner.PID, owner.StartedAt)
+		if err := os.RemoveAll(m.lockFilePath(repo)); err != nil {
+			log.Errorf("unable to remove lock file of %s: %v", repo, err)
+		}
+	}
+}
+
+//remove all the lock files held by this process
+func (m *lockManager) unlockAll() {
+	m.Lock()
+	defer m.Unlock()
+	for repo := range m.locks {
+		if err := os.RemoveAll(m.lockFilePath(repo)); err != nil {
+			log.Errorf("unable to remove lock file of %s: %v", repo, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockpack_locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newLockManager(dir)
+	unlock, err := m.lock(context.Background(), "app", "push 1", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.tryLock("app", "delete"); ok {
+		t.Fatal("app should be locked")
+	}
+
+	owner := lockOwner{}
+	data, err := ioutil.ReadFile(m.lockFilePath("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner.PID != os.Getpid() || owner.Holder != "push 1" {
+		t.Fatalf("unexpected lock owner %#v", owner)
+	}
+
+	//pushes are served in order
+	order := make(chan string, 2)
+	for _, holder := range []string{"push 2", "push 3"} {
+		var out bytes.Buffer
+		go func(holder string) {
+			unlock, err := m.lock(context.Background(), "app", holder, &out)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- holder
+			unlock()
+		}(holder)
+		time.Sleep(50 * time.Millisecond) //make sure push 2 is queued first
+	}
+	unlock()
+
+	for _, expected := range []string{"push 2", "push 3"} {
+		select {
+		case holder := <-order:
+			if holder != expected {
+				t.Fatalf("expected %s to get the lock, got %s", expected, holder)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s never got the lock", expected)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(m.lockFilePath("app")); !os.IsNotExist(err) {
+		t.Fatalf("lock file should be removed, got %v", err)
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		owner lockOwner
+		stale bool
+	}{
+		{lockOwner{PID: os.Getppid(), Hostname: hostname}, false},
+		{lockOwner{PID: os.Getpid(), Hostname: hostname}, true},
+		{lockOwner{PID: os.Getppid(), Hostname: hostname + "_other"}, true},
+		{lockOwner{PID: 1 << 22, Hostname: hostname}, true}, //above linux pid_max
+	}
+	for _, test := range tests {
+		if test.owner.stale() != test.stale {
+			t.Errorf("%#v: expected stale %v", test.owner, test.stale)
+		}
+	}
+}
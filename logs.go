@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	logsDir     = "sandbox/logs"
+	logCompress = true        //gzip the logs of finished builds
+	logMaxAge   time.Duration //logs older than this are removed, 0 to keep them forever
+	logMaxCount = 1000        //number of build logs kept, 0 for no limit
+	errNoLog    = errors.New("log not found")
+)
+
+func init() {
+	if dir := os.Getenv("LOGS_DIR"); dir != "" {
+		logsDir = dir
+	}
+	if c := os.Getenv("LOG_COMPRESS"); c != "" {
+		var err error
+		if logCompress, err = strconv.ParseBool(c); err != nil {
+			panic(fmt.Sprintf("invalid LOG_COMPRESS: %q", c))
+		}
+	}
+	if age := os.Getenv("LOG_MAX_AGE"); age != "" {
+		var err error
+		if logMaxAge, err = time.ParseDuration(age); err != nil {
+			panic(fmt.Sprintf("invalid LOG_MAX_AGE: %v", err))
+		}
+	}
+	if count := os.Getenv("LOG_MAX_COUNT"); count != "" {
+		var err error
+		if logMaxCount, err = strconv.Atoi(count); err != nil || logMaxCount < 0 {
+			panic(fmt.Sprintf("invalid LOG_MAX_COUNT: %q", count))
+		}
+	}
+}
+
+//build logs written in a folder, one file per build (<id>.log or <id>.log.gz once compressed)
+type logArchive struct {
+	dir      string
+	compress bool
+	maxAge   time.Duration
+	maxCount int
+}
+
+func newLogArchive(dir string, compress bool, maxAge time.Duration, maxCount int) (*logArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &logArchive{dir: dir, compress: compress, maxAge: maxAge, maxCount: maxCount}, nil
+}
+
+func (a *logArchive) path(id string) string {
+	return filepath.Join(a.dir, id+".log")
+}
+
+//log file of a new build
+func (a *logArchive) create(id string) (*os.File, error) {
+	return os.Create(a.path(id))
+}
+
+//the build is done, compress its log and apply the retention policy
+func (a *logArchive) archive(id string) {
+	if a.compress {
+		if err := a.gzip(id); err != nil {
+			log.Errorf("unable to compress log of build %s: %v", id, err)
+		}
+	}
+	if err := a.prune(); err != nil {
+		log.Errorf("unable to remove old build logs: %v", err)
+	}
+}
+
+//the compressed log is written aside, the log may be read meanwhile
+func (a *logArchive) gzip(id string) error {
+	src, err := os.Open(a.path(id))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(a.dir, id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(dst.Name(), a.path(id)+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(a.path(id))
+}
+
+//returns the log of a build, errNoLog if it doesn't exist (e.g. removed by the retention policy)
+func (a *logArchive) open(id string) (io.ReadCloser, error) {
+	if r, err := a.openGzip(id); err == nil || !os.IsNotExist(err) {
+		return r, err
+	}
+	f, err := os.Open(a.path(id))
+	if os.IsNotExist(err) {
+		//the log may have been compressed meanwhile
+		if r, err := a.openGzip(id); err == nil || !os.IsNotExist(err) {
+			return r, err
+		}
+		return nil, errNoLog
+	}
+	return f, err
+}
+
+func (a *logArchive) openGzip(id string) (io.ReadCloser, error) {
+	f, err := os.Open(a.path(id) + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+//remove the logs older than maxAge and the oldest ones above maxCount
+func (a *logArchive) prune() error {
+	infos, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+	logs := []os.FileInfo{}
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".log") || strings.HasSuffix(info.Name(), ".log.gz") {
+			logs = append(logs, info)
+		}
+	}
+	//most recent first
+	sort.Slice(logs, func(i, j int) bool { return logs[i].ModTime().After(logs[j].ModTime()) })
+
+	for i, info := range logs {
+		expired := a.maxAge > 0 && time.Since(info.ModTime()) > a.maxAge
+		if expired || (a.maxCount > 0 && i >= a.maxCount) {
+			if err := os.Remove(filepath.Join(a.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestLogArchive(t *testing.T, compress bool) (*logArchive, func()) {
+	dir, err := ioutil.TempDir("", "dockpack-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newLogArchive(filepath.Join(dir, "logs"), compress, 0, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return a, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func writeTestLog(t *testing.T, a *logArchive, id, content string) {
+	f, err := a.create(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(content))
+	f.Close()
+}
+
+func readTestLog(a *logArchive, id string) (string, error) {
+	f, err := a.open(id)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	return string(b), err
+}
+
+func TestLogArchive(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		a, cleanup := newTestLogArchive(t, compress)
+
+		writeTestLog(t, a, "b1", "building b1\n")
+		a.archive("b1")
+		if _, err := os.Stat(a.path("b1") + ".gz"); (err == nil) != compress {
+			t.Errorf("compress %v: unexpected compressed log state: %v", compress, err)
+		}
+		if content, err := readTestLog(a, "b1"); err != nil || content != "building b1\n" {
+			t.Errorf("compress %v: unexpected log %q (%v)", compress, content, err)
+		}
+		if _, err := a.open("unknown"); err != errNoLog {
+			t.Errorf("compress %v: expected errNoLog, got %v", compress, err)
+		}
+		cleanup()
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	a, cleanup := newTestLogArchive(t, true)
+	defer cleanup()
+
+	now := time.Now()
+	for i, id := range []string{"b1", "b2", "b3", "b4"} {
+		writeTestLog(t, a, id, id)
+		a.gzip(id)
+		//b1 is the oldest log
+		mtime := now.Add(time.Duration(i-3) * 24 * time.Hour)
+		if err := os.Chtimes(a.path(id)+".gz", mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.maxCount = 3
+	if err := a.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.open("b1"); err != errNoLog {
+		t.Errorf("expected oldest log to be removed above max count, got %v", err)
+	}
+
+	a.maxAge = 36 * time.Hour
+	if err := a.prune(); err != nil {
+		t.Fatal(err)
+	}
+	for id, kept := range map[string]bool{"b2": false, "b3": true, "b4": true} {
+		if _, err := a.open(id); (err == nil) != kept {
+			t.Errorf("%s: expected kept %v, got %v", id, kept, err)
+		}
+	}
+}
+
+func TestFollowArchivedLog(t *testing.T) {
+	a, cleanup := newTestLogArchive(t, true)
+	defer cleanup()
+
+	r := newBuildRegistry()
+	r.logs = a
+	writeTestLog(t, a, "b1", "building b1\n")
+	a.archive("b1")
+
+	//builds of a previous process have no log in memory
+	var buf bytes.Buffer
+	if err := r.followLog(buildRecord{ID: "b1"}, &buf); err != nil || buf.String() != "building b1\n" {
+		t.Errorf("unexpected log %q (%v)", buf.String(), err)
+	}
+	if err := r.followLog(buildRecord{ID: "b2"}, &buf); err != errNoLog {
+		t.Errorf("expected errNoLog, got %v", err)
+	}
+}
+
+func TestFinishedBuildLogReleased(t *testing.T) {
+	a, cleanup := newTestLogArchive(t, true)
+	defer cleanup()
+
+	r := newBuildRegistry()
+	r.logs = a
+	rec, _, _ := r.start(context.Background(), &buildRequest{Repo: "app", Ref: "a1", RefName: "refs/heads/master"})
+	rec.log.Write([]byte("step 1\n"))
+
+	//a watcher attached before the end of the build gets the whole output
+	running, _ := r.get(rec.ID)
+	followed := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		r.followLog(running, &buf)
+		followed <- buf.String()
+	}()
+	rec.log.Write([]byte("step 2\n"))
+	r.finish(rec, nil, nil)
+	if out := <-followed; out != "step 1\nstep 2\n" {
+		t.Errorf("unexpected followed log %q", out)
+	}
+
+	finished, _ := r.get(rec.ID)
+	if finished.log != nil {
+		t.Fatal("expected the log of a finished build to be released from memory")
+	}
+	var buf bytes.Buffer
+	if err := r.followLog(finished, &buf); err != nil || buf.String() != "step 1\nstep 2\n" {
+		t.Errorf("unexpected archived log %q (%v)", buf.String(), err)
+	}
+}
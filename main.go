@@ -1,23 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 var (
-	version  string //set by the makefile
-	sshPort  string
-	httpPort string
+	version    string //set by the makefile
+	sshPort    string
+	publicHost string //host name given to git clients to follow async builds
+
+	shutdownTimeout = 10 * time.Minute //time given to running builds to finish on SIGTERM
 )
 
 const (
-	buildErrorPrefix = "BUILD ERROR"
+	cancelTimeout = 30 * time.Second //time given to cancelled builds to cleanup
 )
 
 func init() {
@@ -26,33 +36,58 @@ func init() {
 		sshPort = "9999"
 	}
 
-	var err error
-	httpPort, err = freePort()
-	if err != nil {
-		panic(err)
+	publicHost = os.Getenv("PUBLIC_HOST")
+	if publicHost == "" {
+		publicHost, _ = os.Hostname()
+	}
+
+	if timeout := os.Getenv("SHUTDOWN_TIMEOUT"); timeout != "" {
+		var err error
+		shutdownTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			panic(fmt.Sprintf("invalid SHUTDOWN_TIMEOUT: %v", err))
+		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hostkey" {
+		if err := hostKeyCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		//run by git, errors are displayed to the git client
+		if err := hookCommand(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 
-		type body struct {
-			Repo string `json:"repo"`
-			Ref  string `json:"ref"`
-		}
-		var b body
-		err := decoder.Decode(&b)
+		var req buildRequest
+		err := decoder.Decode(&req)
 		if err != nil {
 			log.Error(err)
 		}
-		log.Infof("Payload: %#v", b)
-		handleApp(w, b.Repo, b.Ref)
+		//push options may hold secrets (env.KEY=VALUE)
+		log.Infof("build request for repo %s ref %s (%s), push options: %v", req.Repo, req.Ref, req.RefName, redactPushOptions(req.PushOptions))
+		handleApp(r.Context(), w, &req)
 	})
+	http.HandleFunc("/builds/", handleBuildStatus)
 
+	//the pre-receive hooks reach the server through a unix socket in the sandbox
+	hookListener, err := listenHookSocket(filepath.Join("sandbox", hookSocketName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	httpServer := &http.Server{}
 	go func() {
-		if err := http.ListenAndServe(":"+httpPort, nil); err != nil {
+		if err := httpServer.Serve(hookListener); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -63,9 +98,81 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if err := s.start(sshPort); err != nil {
+	//build history
+	store, err := openBuildStore(storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := registry.useStore(store); err != nil {
+		log.Fatal(err)
+	}
+	logs, err := newLogArchive(logsDir, logCompress, logMaxAge, logMaxCount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := logs.prune(); err != nil {
+		log.Errorf("unable to remove old build logs: %v", err)
+	}
+	registry.logs = logs
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- s.start(sshPort)
+	}()
+
+	//health checks are always served, the API requires a token
+	apiServer := &http.Server{Addr: ":" + apiPort, Handler: newAPIServer(s, apiToken)}
+	go func() {
+		if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+			errc <- err
+		}
+	}()
+	log.Infof("API listening on port %s", apiPort)
+	if apiToken == "" {
+		log.Info("API_TOKEN not set, only health checks are served")
+	}
+	servers := []*http.Server{httpServer, apiServer}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
 		log.Fatal(err)
+	case sig := <-sigc:
+		log.Infof("received %s", sig)
+	}
+	shutdown(s, servers)
+}
+
+//stop accepting pushes, let running builds finish until the shutdown timeout and cancel the remaining ones
+func shutdown(s *server, httpServers []*http.Server) {
+	log.Infof("shutting down, waiting up to %s for running builds", shutdownTimeout)
+	s.stopAccepting()
+	registry.stopAccepting() //the hook socket and the API are still served during the drain
+
+	//async builds are not bound to a session
+	deadline := time.Now().Add(shutdownTimeout)
+	if !s.wait(shutdownTimeout) || !registry.wait(time.Until(deadline)+cancelTimeout) {
+		log.Warn("shutdown timeout reached, cancelling running builds")
+		registry.cancelAll()
+		if !registry.wait(cancelTimeout) {
+			log.Error("some builds didn't stop, their containers may need to be removed manually")
+		}
+		s.wait(cancelTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Errorf("unable to shutdown http server: %v", err)
+		}
 	}
+	locks.unlockAll()
+	if err := registry.store.close(); err != nil {
+		log.Errorf("unable to close build store: %v", err)
+	}
+	log.Info("bye")
 }
 
 type flushWriter struct {
@@ -81,36 +188,209 @@ func (fw *flushWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
-func handleApp(w http.ResponseWriter, repo, ref string) {
+//a previous socket is left behind if dockpack was killed
+func listenHookSocket(path string) (net.Listener, error) {
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+//ctx is cancelled if the hook stops waiting for the build (e.g. git client disconnected).
+//The build output is streamed to the hook, the result is sent in a trailer once the build is done
+func handleApp(ctx context.Context, w http.ResponseWriter, req *buildRequest) {
+	w.Header().Set("Trailer", buildResultTrailer)
 	fw := &flushWriter{w: w}
 	if f, ok := w.(http.Flusher); ok {
 		fw.f = f
 	}
 
-	//from here we should start the build and write output to w
-	fw.Write([]byte(fmt.Sprintf("starting build for repo %s ref %s\n", repo, ref)))
-	b, err := newBuilder(fw, repo, ref)
-	if err != nil {
-		log.Errorf("unable to instanciate builder: %v", err)
-		fw.Write([]byte(fmt.Sprintf("unable to instanciate builder: %v\n", err)))
+	src := &hookSource{repo: req.Repo, ref: req.Ref}
+	build := func() (*buildRecord, error) { return runBuild(ctx, fw, req, src) }
+	if req.Async {
+		build = func() (*buildRecord, error) { return queueBuild(fw, req, src) }
+	}
+
+	rec, err := build()
+	result, _ := json.Marshal(newBuildOutcome(rec, err, req.Async))
+	w.Header().Set(buildResultTrailer, string(result))
+}
+
+//GET /builds/<id> returns the status of a build
+func handleBuildStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	b, ok := registry.get(strings.TrimPrefix(r.URL.Path, "/builds/"))
+	if !ok {
+		http.Error(w, "build not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+//build a pushed ref if it matches the build rules and notify the web hook, output is written to w.
+//Returns the build (nil if the ref is not built) and an error if the ref must be rejected
+func runBuild(ctx context.Context, w io.Writer, req *buildRequest, src buildSource) (*buildRecord, error) {
+	defer cleanupSource(src)
 
-	br, err := b.build()
+	cfg, opts, err := prepareBuild(w, req)
+	if err != nil || opts == nil {
+		return nil, err
+	}
+
+	//from here we should start the build and write output to w, output is also kept in the build log
+	rec, ctx, err := registry.start(ctx, req)
 	if err != nil {
-		log.Errorf("build failed: %v", err)
-		fw.Write([]byte(fmt.Sprintf("%s - %v\n", buildErrorPrefix, err)))
-		return
+		w.Write([]byte(fmt.Sprintf("%v\n", err)))
+		return nil, err
 	}
+	return rec, execBuild(ctx, w, rec, req, cfg, opts, src)
+}
 
-	hook := os.Getenv("WEB_HOOK")
-	if hook == "" {
-		return
+//build a pushed ref in background, the git client is only given the build id to follow its logs.
+//Failures are reported to the web hook
+func queueBuild(w io.Writer, req *buildRequest, src buildSource) (*buildRecord, error) {
+	cfg, opts, err := prepareBuild(w, req)
+	if err != nil || opts == nil {
+		cleanupSource(src)
+		return nil, err
+	}
+	return startAsyncBuild(w, req, cfg, opts, src)
+}
+
+//the build is not bound to the push, it can only be cancelled with the cancel command or a shutdown
+func startAsyncBuild(w io.Writer, req *buildRequest, cfg *config, opts *buildOptions, src buildSource) (*buildRecord, error) {
+	req.Async = true
+	rec, ctx, err := registry.start(context.Background(), req)
+	if err != nil {
+		cleanupSource(src)
+		w.Write([]byte(fmt.Sprintf("%v\n", err)))
+		return nil, err
+	}
+	w.Write([]byte(fmt.Sprintf("build %s queued for repo %s ref %s, follow it with:\n  ssh -p %s %s logs %s\n", rec.ID, req.Repo, req.RefName, sshPort, publicHost, rec.ID)))
+
+	go func() {
+		defer cleanupSource(src)
+		execBuild(ctx, ioutil.Discard, rec, req, cfg, opts, src)
+	}()
+	return rec, nil
+}
+
+func cleanupSource(src buildSource) {
+	if err := src.cleanup(); err != nil {
+		log.Errorf("unable to cleanup build sources: %v", err)
+	}
+}
+
+//check the pushed ref against the config and the push options. Returns nil options if the ref must not be built
+func prepareBuild(w io.Writer, req *buildRequest) (*config, *buildOptions, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Errorf("unable to load config: %v", err)
+		w.Write([]byte(fmt.Sprintf("unable to load config: %v\n", err)))
+		return nil, nil, err
+	}
+
+	var skip string
+	if tag := req.gitTag(); tag != "" {
+		if !req.isRelease() {
+			skip = fmt.Sprintf("tag %s is not a semver release tag (e.g. v1.2.3)", tag)
+		}
+	} else if branch := req.branch(); !cfg.shouldBuild(req.Repo, branch) {
+		skip = fmt.Sprintf("branch %s does not match any build rule of repo %s", branch, req.Repo)
 	}
 
-	if err := put(hook, br, fw); err != nil {
-		m := fmt.Sprintf("unable to notify hook %q: %v", hook, err)
-		log.Errorf(m)
-		fw.Write([]byte(m))
+	if skip != "" {
+		w.Write([]byte(fmt.Sprintf("%s, skipping build\n", skip)))
+		return cfg, nil, nil
+	}
+
+	opts, err := parsePushOptions(req.PushOptions)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("%v\n", err)))
+		return nil, nil, err
+	}
+	return cfg, opts, nil
+}
+
+func execBuild(ctx context.Context, w io.Writer, rec *buildRecord, req *buildRequest, cfg *config, opts *buildOptions, src buildSource) error {
+	out := io.MultiWriter(w, rec.log)
+	if req.isRelease() {
+		out.Write([]byte(fmt.Sprintf("starting release build %s for repo %s tag %s ref %s\n", rec.ID, req.Repo, req.gitTag(), req.Ref)))
+	} else {
+		out.Write([]byte(fmt.Sprintf("starting build %s for repo %s branch %s ref %s\n", rec.ID, req.Repo, req.branch(), req.Ref)))
+	}
+
+	//a newer push of the branch makes its running build useless
+	if req.branch() != "" && cfg.supersede(req.Repo) {
+		for _, b := range registry.supersede(rec) {
+			out.Write([]byte(fmt.Sprintf("cancelling build %s of ref %s, superseded by this push\n", b.ID, b.Ref)))
+		}
+	}
+
+	//builds of a repo run one at a time, within the global concurrency limit
+	var br *buildResult
+	unlock, err := locks.lock(ctx, req.Repo, fmt.Sprintf("build %s", rec.ID), out)
+	if err == nil {
+		var release func()
+		if release, err = scheduler.acquire(ctx, req.Repo, out); err == nil {
+			registry.run(rec)
+			br, err = buildApp(ctx, out, req, opts, src)
+			release()
+		}
+		unlock()
+	}
+	if ctx.Err() != nil {
+		err = errBuildCancelled
+	}
+	if err != nil {
+		msg := fmt.Sprintf("build %s failed: %v", rec.ID, err)
+		if err == errBuildCancelled {
+			msg = fmt.Sprintf("build %s cancelled", rec.ID)
+		}
+		if b, _ := registry.get(rec.ID); b.SupersededBy != "" {
+			msg = fmt.Sprintf("build %s cancelled, superseded by build %s of a newer push", rec.ID, b.SupersededBy)
+		}
+		log.Error(msg)
+		out.Write([]byte(msg + "\n"))
+	}
+	if err == nil {
+		br.Status = statusSucceeded
+	}
+	registry.finish(rec, br, err)
+	switch {
+	case err == errBuildCancelled:
+		//the hook is told about cancelled builds, nothing was pushed
+		br = &buildResult{Repo: req.Repo, Branch: req.branch(), Release: req.isRelease(), GitTag: req.gitTag(), Status: statusCancelled}
+	case err != nil && req.Async:
+		//nobody is waiting for an async build, the hook is the only one to know it failed
+		br = &buildResult{Repo: req.Repo, Branch: req.branch(), Release: req.isRelease(), GitTag: req.gitTag(), Status: statusFailed, Error: err.Error()}
+	case err != nil:
+		return err
+	}
+
+	if hook := os.Getenv("WEB_HOOK"); hook != "" {
+		if opts.SkipPush {
+			w.Write([]byte(fmt.Sprintf("image not pushed, not notifying hook %q\n", hook)))
+		} else if err := put(hook, br, w); err != nil {
+			webhookDeliveries.WithLabelValues("failure").Inc()
+			m := fmt.Sprintf("unable to notify hook %q: %v", hook, err)
+			log.Errorf(m)
+			w.Write([]byte(m))
+		} else {
+			webhookDeliveries.WithLabelValues("success").Inc()
+		}
+	}
+	return err
+}
+
+func buildApp(ctx context.Context, w io.Writer, req *buildRequest, opts *buildOptions, src buildSource) (*buildResult, error) {
+	b, err := newBuilder(w, req, opts, src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to instanciate builder: %v", err)
 	}
+	return b.build(ctx)
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//metrics exposed on /metrics
+var (
+	buildsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dockpack_builds_total",
+		Help: "Finished builds by repo and status.",
+	}, []string{"repo", "status"})
+
+	buildPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dockpack_build_phase_duration_seconds",
+		Help:    "Duration of the successful build phases.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"phase"})
+
+	buildsQueued = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dockpack_build_queue_depth",
+		Help: "Builds waiting for their repo lock or a build slot.",
+	}, func() float64 {
+		return float64(registry.count(statusQueued))
+	})
+
+	buildsRunning = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "dockpack_builds_running",
+		Help: "Running builds.",
+	}, func() float64 {
+		return float64(registry.count(statusRunning))
+	})
+
+	sshConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dockpack_ssh_connections",
+		Help: "Open ssh connections.",
+	})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dockpack_auth_failures_total",
+		Help: "Rejected ssh keys (key) and denied repository accesses (repo).",
+	}, []string{"reason"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dockpack_webhook_deliveries_total",
+		Help: "Web hook notifications by result.",
+	}, []string{"result"})
+
+	metricsHandler = promhttp.Handler()
+)
+
+func init() {
+	prometheus.MustRegister(buildsTotal, buildPhaseDuration, buildsQueued, buildsRunning, sshConnections, authFailures, webhookDeliveries)
+}
+
+//record the duration of a build phase started at start, returns the start of the next phase
+func observePhase(phase string, start time.Time) time.Time {
+	now := time.Now()
+	buildPhaseDuration.WithLabelValues(phase).Observe(now.Sub(start).Seconds())
+	return now
+}
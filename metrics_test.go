@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIMetrics(t *testing.T) {
+	a, cleanup := newTestAPI(t)
+	defer cleanup()
+	a.token = "" //metrics are available without API token
+
+	authFailures.WithLabelValues("key").Inc()
+	observePhase("pull", time.Now().Add(-2*time.Second))
+	w := apiRequest(a, "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	for _, sample := range []string{
+		"dockpack_build_queue_depth ",
+		"dockpack_ssh_connections ",
+		`dockpack_auth_failures_total{reason="key"} `,
+		`dockpack_build_phase_duration_seconds_bucket{phase="pull",le="5"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), "\n"+sample) {
+			t.Errorf("sample %s not found in:\n%s", sample, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/sideband"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gitserver "gopkg.in/src-d/go-git.v4/plumbing/transport/server"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+//git-receive-pack and git-upload-pack implemented in process (no git binary nor pre-receive hook required),
+//enabled with GIT_BACKEND=native
+var nativeGit = os.Getenv("GIT_BACKEND") == "native"
+
+var (
+	errStaleRef    = errors.New("stale info")
+	errBuildFailed = errors.New("build failed")
+)
+
+//error of a single reference update, reported to the client
+type refUpdateError struct {
+	Ref plumbing.ReferenceName
+	Err error
+}
+
+func (e *refUpdateError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Ref, e.Err)
+}
+
+//reference update request sent by git push
+type updateRequest struct {
+	capabilities *capability.List
+	commands     []*packp.Command
+	options      []string
+	packfile     io.Reader
+}
+
+//decode the commands, push options and packfile sent by the client, go-git decoder doesn't support push options
+func decodeUpdateRequest(r io.Reader) (*updateRequest, error) {
+	req := &updateRequest{capabilities: capability.NewList()}
+	s := pktline.NewScanner(r)
+
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) == 0 {
+			break //flush-pkt
+		}
+		if len(req.commands) == 0 {
+			i := bytes.IndexByte(line, 0)
+			if i == -1 {
+				return nil, fmt.Errorf("malformed request: missing capabilities")
+			}
+			if err := req.capabilities.Decode(bytes.TrimSuffix(line[i+1:], []byte("\n"))); err != nil {
+				return nil, err
+			}
+			line = line[:i]
+		}
+		cmd, err := parseCommand(line)
+		if err != nil {
+			return nil, err
+		}
+		req.commands = append(req.commands, cmd)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(req.commands) > 0 && req.capabilities.Supports(capability.PushOptions) {
+		for s.Scan() && len(s.Bytes()) > 0 {
+			req.options = append(req.options, string(bytes.TrimSuffix(s.Bytes(), []byte("\n"))))
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	//no packfile is sent when only deleting references
+	for _, cmd := range req.commands {
+		if cmd.Action() != packp.Delete {
+			req.packfile = r
+			break
+		}
+	}
+	return req, nil
+}
+
+func parseCommand(line []byte) (*packp.Command, error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("malformed command %q", line)
+	}
+	hashes := []plumbing.Hash{}
+	for _, f := range fields[:2] {
+		if len(f) != 40 {
+			return nil, fmt.Errorf("malformed command %q: invalid hash", line)
+		}
+		hashes = append(hashes, plumbing.NewHash(string(f)))
+	}
+	return &packp.Command{Name: plumbing.ReferenceName(fields[2]), Old: hashes[0], New: hashes[1]}, nil
+}
+
+func openStorage(repoPath string) *filesystem.Storage {
+	return filesystem.NewStorage(osfs.New(repoPath), cache.NewObjectLRUDefault())
+}
+
+//serve a git push: store the objects, build each pushed ref and only update the ones that built successfully
+func (s *server) serveReceivePack(ctx context.Context, ch ssh.Channel, repo, repoPath, pusher string) error {
+	st := openStorage(repoPath)
+
+	ar := packp.NewAdvRefs()
+	for _, c := range []capability.Capability{capability.OFSDelta, capability.DeleteRefs, capability.ReportStatus, capability.Sideband64k, capability.PushOptions} {
+		if err := ar.Capabilities.Set(c); err != nil {
+			return err
+		}
+	}
+	if err := ar.Capabilities.Set(capability.Agent, "dockpack/"+version); err != nil {
+		return err
+	}
+	refs, err := st.IterReferences()
+	if err != nil {
+		return err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			ar.References[ref.Name().String()] = ref.Hash()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := ar.Encode(ch); err != nil {
+		return err
+	}
+
+	req, err := decodeUpdateRequest(ch)
+	if err != nil {
+		return err
+	}
+	if len(req.commands) == 0 {
+		return nil //nothing to update
+	}
+
+	//build output goes on the progress side band if supported
+	var progress io.Writer = ch.Stderr()
+	var mux *sideband.Muxer
+	if req.capabilities.Supports(capability.Sideband64k) {
+		mux = sideband.NewMuxer(sideband.Sideband64k, ch)
+		progress = &progressWriter{mux: mux}
+	}
+
+	rs := packp.NewReportStatus()
+	rs.UnpackStatus = "ok"
+	if req.packfile != nil {
+		if err := packfile.UpdateObjectStorage(st, req.packfile); err != nil {
+			rs.UnpackStatus = err.Error()
+		}
+	}
+
+	for _, cmd := range req.commands {
+		status := "ok"
+		if rs.UnpackStatus != "ok" {
+			status = "unpacker error"
+		} else if err := s.updateReference(ctx, st, repo, pusher, cmd, req.options, progress); err != nil {
+			log.Errorf("unable to update reference of %s: %v", repo, err)
+			status = err.Error()
+			if rerr, ok := err.(*refUpdateError); ok {
+				status = rerr.Err.Error()
+			}
+		}
+		rs.CommandStatuses = append(rs.CommandStatuses, &packp.CommandStatus{ReferenceName: cmd.Name, Status: status})
+	}
+
+	if !req.capabilities.Supports(capability.ReportStatus) {
+		return nil
+	}
+	if mux == nil {
+		return rs.Encode(ch)
+	}
+
+	var buf bytes.Buffer
+	if err := rs.Encode(&buf); err != nil {
+		return err
+	}
+	if _, err := mux.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	_, err = ch.Write(pktline.FlushPkt)
+	return err
+}
+
+func (s *server) updateReference(ctx context.Context, st *filesystem.Storage, repo, pusher string, cmd *packp.Command, options []string, w io.Writer) error {
+	//the client must have seen the current value of the ref
+	if err := checkOldValue(st, cmd); err != nil {
+		return &refUpdateError{cmd.Name, err}
+	}
+
+	if cmd.Action() == packp.Delete {
+		if err := st.RemoveReference(cmd.Name); err != nil {
+			return &refUpdateError{cmd.Name, err}
+		}
+		return nil
+	}
+
+	req := &buildRequest{
+		Repo:        repo,
+		Ref:         cmd.New.String(),
+		RefName:     cmd.Name.String(),
+		PushOptions: options,
+		Pusher:      pusher,
+	}
+	src := &treeSource{storage: st, hash: cmd.New}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return &refUpdateError{cmd.Name, err}
+	}
+	if cfg.async(repo) {
+		return s.updateReferenceAsync(st, cmd, req, src, w)
+	}
+
+	if _, err := runBuild(ctx, w, req, src); err != nil {
+		return &refUpdateError{cmd.Name, errBuildFailed}
+	}
+
+	//the ref may have been updated by another push during the build
+	if err := checkOldValue(st, cmd); err != nil {
+		return &refUpdateError{cmd.Name, err}
+	}
+	if err := st.SetReference(plumbing.NewHashReference(cmd.Name, cmd.New)); err != nil {
+		return &refUpdateError{cmd.Name, err}
+	}
+	return nil
+}
+
+//the ref is updated before the build, it is only rejected if the push options are invalid
+func (s *server) updateReferenceAsync(st *filesystem.Storage, cmd *packp.Command, req *buildRequest, src buildSource, w io.Writer) error {
+	cfg, opts, err := prepareBuild(w, req)
+	if err != nil {
+		return &refUpdateError{cmd.Name, errBuildFailed}
+	}
+	if err := st.SetReference(plumbing.NewHashReference(cmd.Name, cmd.New)); err != nil {
+		return &refUpdateError{cmd.Name, err}
+	}
+	//the ref is already updated, a build refused during a shutdown is only reported to the client
+	if opts != nil {
+		startAsyncBuild(w, req, cfg, opts, src)
+	}
+	return nil
+}
+
+func checkOldValue(st *filesystem.Storage, cmd *packp.Command) error {
+	current, err := st.Reference(cmd.Name)
+	switch {
+	case err == plumbing.ErrReferenceNotFound:
+		if cmd.Old != plumbing.ZeroHash {
+			return errStaleRef
+		}
+	case err != nil:
+		return err
+	case current.Hash() != cmd.Old:
+		return errStaleRef
+	}
+	return nil
+}
+
+//serve a git fetch or clone
+func (s *server) serveUploadPack(ctx context.Context, ch ssh.Channel, repoPath string) error {
+	ep, err := transport.NewEndpoint("/")
+	if err != nil {
+		return err
+	}
+	srv := gitserver.NewServer(gitserver.MapLoader{ep.String(): openStorage(repoPath)})
+	sess, err := srv.NewUploadPackSession(ep, nil)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	ar, err := sess.AdvertisedReferences()
+	if err != nil {
+		return err
+	}
+	if err := ar.Encode(ch); err != nil {
+		return err
+	}
+
+	//a flush-pkt means the client only wanted the references (e.g. git ls-remote)
+	r := bufio.NewReader(ch)
+	if b, err := r.Peek(4); err == io.EOF || (err == nil && bytes.Equal(b, pktline.FlushPkt)) {
+		return nil
+	}
+
+	req := packp.NewUploadPackRequest()
+	if err := req.Decode(r); err != nil {
+		return err
+	}
+
+	resp, err := sess.UploadPack(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return resp.Encode(ch)
+}
+
+//write progress messages on the side band, build output may be written concurrently
+type progressWriter struct {
+	sync.Mutex
+	mux *sideband.Muxer
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.mux.WriteChannel(sideband.ProgressMessage, p)
+}
+
+//sources of a pushed commit read from the git object storage, the archive is streamed to the build container
+type treeSource struct {
+	storage *filesystem.Storage
+	hash    plumbing.Hash
+}
+
+func (s *treeSource) tree() (*object.Tree, error) {
+	obj, err := object.GetObject(s.storage, s.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	//annotated tags point to a commit
+	if tag, ok := obj.(*object.Tag); ok {
+		if obj, err = tag.Object(); err != nil {
+			return nil, err
+		}
+	}
+
+	commit, ok := obj.(*object.Commit)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a commit", s.hash)
+	}
+	return commit.Tree()
+}
+
+func (s *treeSource) archive() (io.ReadCloser, error) {
+	tree, err := s.tree()
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTreeArchive(tree, w))
+	}()
+	return r, nil
+}
+
+func writeTreeArchive(tree *object.Tree, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := tree.Files().ForEach(func(f *object.File) error {
+		hdr := &tar.Header{
+			Name: f.Name,
+			Mode: 0644,
+			Size: f.Size,
+		}
+
+		switch f.Mode {
+		case filemode.Executable:
+			hdr.Mode = 0755
+		case filemode.Symlink:
+			target, err := f.Contents()
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target
+			hdr.Size = 0
+			hdr.Mode = 0777
+			return tw.WriteHeader(hdr)
+		case filemode.Submodule:
+			return nil
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (s *treeSource) procfile() (io.ReadCloser, error) {
+	tree, err := s.tree()
+	if err != nil {
+		return nil, err
+	}
+	f, err := tree.File("Procfile")
+	if err != nil {
+		return nil, err
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(content)), nil
+}
+
+func (s *treeSource) cleanup() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/pktline"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp"
+	"gopkg.in/src-d/go-git.v4/plumbing/protocol/packp/capability"
+)
+
+const (
+	zero = "0000000000000000000000000000000000000000"
+	sha1 = "8c42402acef41b5aaa14b1b6cb7d4b4f82c5a6fc"
+	sha2 = "d6e4f1c3ba0a2d4b1b8c9bd0d1a0a5b6c7d8e9f0"
+)
+
+func encodePktLines(t *testing.T, lines ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	e := pktline.NewEncoder(&buf)
+	for _, l := range lines {
+		var err error
+		if l == "" {
+			err = e.Flush()
+		} else {
+			err = e.EncodeString(l)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestDecodeUpdateRequest(t *testing.T) {
+	buf := encodePktLines(t,
+		fmt.Sprintf("%s %s refs/heads/master\x00report-status side-band-64k push-options", zero, sha1),
+		fmt.Sprintf("%s %s refs/heads/staging", sha1, sha2),
+		"",
+		"no-cache\n",
+		"env.FOO=bar\n",
+		"",
+	)
+	buf.WriteString("PACK")
+
+	req, err := decodeUpdateRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(req.commands) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(req.commands))
+	}
+	if req.commands[0].Name != "refs/heads/master" || req.commands[0].Action() != packp.Create {
+		t.Errorf("unexpected first command %#v", req.commands[0])
+	}
+	if req.commands[1].Name != "refs/heads/staging" || req.commands[1].New.String() != sha2 {
+		t.Errorf("unexpected second command %#v", req.commands[1])
+	}
+	for _, c := range []capability.Capability{capability.ReportStatus, capability.Sideband64k, capability.PushOptions} {
+		if !req.capabilities.Supports(c) {
+			t.Errorf("expected capability %s to be decoded", c)
+		}
+	}
+	if expected := []string{"no-cache", "env.FOO=bar"}; !reflect.DeepEqual(req.options, expected) {
+		t.Errorf("got push options %v, expected %v", req.options, expected)
+	}
+
+	pack, err := ioutil.ReadAll(req.packfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pack) != "PACK" {
+		t.Errorf("expected packfile to follow the request, got %q", pack)
+	}
+}
+
+func TestDecodeDeleteRequest(t *testing.T) {
+	buf := encodePktLines(t, fmt.Sprintf("%s %s refs/heads/master\x00report-status", sha1, zero), "")
+
+	req, err := decodeUpdateRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.commands) != 1 || req.commands[0].Action() != packp.Delete {
+		t.Fatalf("expected a single delete command, got %#v", req.commands)
+	}
+	if req.packfile != nil {
+		t.Errorf("expected no packfile when only deleting references")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	imageTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	envKeyRegexp   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+//build parameters set by the client using git push options (git push -o no-cache -o env.FOO=bar)
+type buildOptions struct {
+	NoCache  bool     //do not upload the buildpacks cache into the build container
+	SkipPush bool     //build the image but do not push it to the registry
+	Tag      string   //image tag to use instead of the generated one
+	Env      []string //additional environment of the build container (KEY=VALUE)
+}
+
+//env options may hold secrets, their values are not kept with the builds (env.KEY=VALUE becomes env.KEY)
+func redactPushOptions(options []string) []string {
+	var redacted []string
+	for _, o := range options {
+		if strings.HasPrefix(o, "env.") {
+			o = strings.SplitN(o, "=", 2)[0]
+		}
+		redacted = append(redacted, o)
+	}
+	return redacted
+}
+
+func parsePushOptions(options []string) (*buildOptions, error) {
+	opts := &buildOptions{}
+	for _, o := range options {
+		switch {
+		case o == "no-cache":
+			opts.NoCache = true
+		case o == "skip-push":
+			opts.SkipPush = true
+		case strings.HasPrefix(o, "tag="):
+			tag := strings.TrimPrefix(o, "tag=")
+			if !imageTagRegexp.MatchString(tag) {
+				return nil, fmt.Errorf("invalid push option %q: not a valid image tag", o)
+			}
+			opts.Tag = tag
+		case strings.HasPrefix(o, "env."):
+			kv := strings.SplitN(strings.TrimPrefix(o, "env."), "=", 2)
+			if len(kv) != 2 || !envKeyRegexp.MatchString(kv[0]) {
+				return nil, fmt.Errorf("invalid push option %q: expected env.KEY=VALUE", o)
+			}
+			opts.Env = append(opts.Env, kv[0]+"="+kv[1])
+		default:
+			return nil, fmt.Errorf("unknown push option %q", o)
+		}
+	}
+	return opts, nil
+}
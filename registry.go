@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type buildStatus string
+
+const (
+	statusQueued    buildStatus = "queued"
+	statusRunning   buildStatus = "running"
+	statusSucceeded buildStatus = "succeeded"
+	statusFailed    buildStatus = "failed"
+	statusCancelled buildStatus = "cancelled"
+	statusSkipped   buildStatus = "skipped" //not recorded, the ref doesn't match the build rules
+
+	maxRecentBuilds = 100
+)
+
+var (
+	errBuildCancelled = errors.New("build cancelled")
+	errShuttingDown   = errors.New("dockpack is shutting down, try again later")
+
+	registry = newBuildRegistry()
+)
+
+//a build known by dockpack, running or finished
+type buildRecord struct {
+	ID          string       `json:"id"`
+	Repo        string       `json:"repo"`
+	Ref         string       `json:"ref"`
+	RefName     string       `json:"ref_name"`
+	Pusher      string       `json:"pusher,omitempty"`
+	PushOptions []string     `json:"push_options,omitempty"` //values of env options are redacted
+	Status      buildStatus  `json:"status"`
+	Error       string       `json:"error,omitempty"`
+	QueuedAt    time.Time    `json:"queued_at"`
+	StartedAt   time.Time    `json:"started_at,omitempty"` //zero until the build gets a build slot
+	FinishedAt  time.Time    `json:"finished_at,omitempty"`
+	Result      *buildResult `json:"result,omitempty"`
+
+	SupersededBy string `json:"superseded_by,omitempty"` //id of the build that cancelled this one
+
+	log         *buildLog //nil once archived and for builds of previous dockpack processes
+	cancel      context.CancelFunc
+	pushOptions []string //not redacted, nil for builds of previous dockpack processes
+}
+
+//queued or running
+func (r *buildRecord) active() bool {
+	return r.Status == statusQueued || r.Status == statusRunning
+}
+
+//builds of previous versions were only recorded with their start time
+func (r *buildRecord) queueTime() time.Time {
+	if r.QueuedAt.IsZero() {
+		return r.StartedAt
+	}
+	return r.QueuedAt
+}
+
+//time spent running, the time spent queued is not included
+func (r *buildRecord) duration() time.Duration {
+	switch {
+	case r.StartedAt.IsZero():
+		return 0
+	case r.FinishedAt.IsZero():
+		return time.Since(r.StartedAt)
+	}
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+//keep track of running builds and of the most recent finished ones
+type buildRegistry struct {
+	sync.Mutex
+	builds       []*buildRecord //oldest first
+	active       sync.WaitGroup //running builds
+	shuttingDown bool           //new builds are refused
+	store        *buildStore    //history of all builds, nil if not persisted
+	logs         *logArchive    //logs of all builds, nil if not persisted
+}
+
+func newBuildRegistry() *buildRegistry {
+	return &buildRegistry{}
+}
+
+func newBuildID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+//register a new queued build, the returned context is cancelled when the build is cancelled.
+//Returns errShuttingDown once stopAccepting is called
+func (r *buildRegistry) start(ctx context.Context, req *buildRequest) (*buildRecord, context.Context, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.shuttingDown {
+		return nil, nil, errShuttingDown
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	rec := &buildRecord{
+		ID:          newBuildID(),
+		Repo:        req.Repo,
+		Ref:         req.Ref,
+		RefName:     req.RefName,
+		Pusher:      req.Pusher,
+		PushOptions: redactPushOptions(req.PushOptions),
+		pushOptions: req.PushOptions,
+		Status:      statusQueued,
+		QueuedAt:    time.Now(),
+		log:         newBuildLog(),
+		cancel:      cancel,
+	}
+
+	if r.logs != nil {
+		f, err := r.logs.create(rec.ID)
+		if err != nil {
+			log.Errorf("unable to create log of build %s: %v", rec.ID, err)
+		} else {
+			rec.log.file = f
+		}
+	}
+
+	r.builds = append(r.builds, rec)
+	r.active.Add(1)
+	r.persist(rec)
+
+	//forget about the oldest finished builds
+	for i := 0; len(r.builds) > maxRecentBuilds && i < len(r.builds); {
+		if r.builds[i].active() {
+			i++
+			continue
+		}
+		r.builds = append(r.builds[:i], r.builds[i+1:]...)
+	}
+	return rec, ctx, nil
+}
+
+//the build got a build slot
+func (r *buildRegistry) run(rec *buildRecord) {
+	r.Lock()
+	defer r.Unlock()
+	rec.Status = statusRunning
+	rec.StartedAt = time.Now()
+	r.persist(rec)
+}
+
+func (r *buildRegistry) finish(rec *buildRecord, res *buildResult, err error) {
+	r.Lock()
+	defer r.Unlock()
+	rec.FinishedAt = time.Now()
+	rec.Result = res
+	switch {
+	case err == errBuildCancelled:
+		rec.Status = statusCancelled
+	case err != nil:
+		rec.Status = statusFailed
+		rec.Error = err.Error()
+	default:
+		rec.Status = statusSucceeded
+	}
+	rec.cancel()
+	rec.log.close()
+	if rec.log.archived {
+		//the log is read from the archive from now on, watchers already following it keep the one in memory
+		rec.log = nil
+	}
+	r.active.Done()
+	buildsTotal.WithLabelValues(rec.Repo, string(rec.Status)).Inc()
+	r.persist(rec)
+	if r.logs != nil {
+		go r.logs.archive(rec.ID)
+	}
+}
+
+//record the build in the store, must be called with the registry locked
+func (r *buildRegistry) persist(rec *buildRecord) {
+	if r.store == nil {
+		return
+	}
+	if err := r.store.save(rec); err != nil {
+		log.Errorf("unable to save build %s: %v", rec.ID, err)
+	}
+}
+
+//persist the builds in store, builds interrupted by the previous shutdown are marked as failed
+func (r *buildRegistry) useStore(store *buildStore) error {
+	interrupted, err := store.failInterrupted()
+	if err != nil {
+		return err
+	}
+	for _, rec := range interrupted {
+		log.Warnf("build %s of %s was interrupted by a restart", rec.ID, rec.Repo)
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.store = store
+	return nil
+}
+
+//returns a copy of the build with the given id, older builds are read from the store
+func (r *buildRegistry) get(id string) (buildRecord, bool) {
+	r.Lock()
+	defer r.Unlock()
+	for _, rec := range r.builds {
+		if rec.ID == id {
+			return *rec, true
+		}
+	}
+	if r.store == nil {
+		return buildRecord{}, false
+	}
+	rec, ok, err := r.store.get(id)
+	if err != nil {
+		log.Errorf("unable to read build %s: %v", id, err)
+	}
+	return rec, ok
+}
+
+//returns a copy of known builds of repo (all repos if empty), most recent first
+func (r *buildRegistry) list(repo string) []buildRecord {
+	r.Lock()
+	defer r.Unlock()
+	res := []buildRecord{}
+	for i := len(r.builds) - 1; i >= 0; i-- {
+		if repo == "" || r.builds[i].Repo == repo {
+			res = append(res, *r.builds[i])
+		}
+	}
+	return res
+}
+
+//the max most recent builds of the repos matching match, builds of previous processes are read from the
+//store. Most recent first
+func (r *buildRegistry) history(max int, match func(repo string) bool) []buildRecord {
+	builds := []buildRecord{}
+	for _, rec := range r.list("") {
+		if match(rec.Repo) {
+			builds = append(builds, rec)
+		}
+	}
+	r.Lock()
+	store := r.store
+	r.Unlock()
+
+	if store != nil {
+		stored, err := store.list(max, match)
+		if err != nil {
+			log.Errorf("unable to read builds: %v", err)
+		}
+		//builds of this process are up to date in memory
+		known := map[string]bool{}
+		for _, rec := range builds {
+			known[rec.ID] = true
+		}
+		for _, rec := range stored {
+			if !known[rec.ID] {
+				builds = append(builds, rec)
+			}
+		}
+	}
+	sort.Stable(byQueueDesc(builds))
+	if len(builds) > max {
+		builds = builds[:max]
+	}
+	return builds
+}
+
+//matches the builds of repo, all builds if empty
+func repoBuilds(repo string) func(string) bool {
+	return func(r string) bool { return repo == "" || r == repo }
+}
+
+//write the logs of the build to w, the output of builds of this process is followed until they finish.
+//Returns errNoLog if the log isn't available (nothing is written)
+func (r *buildRegistry) followLog(rec buildRecord, w io.Writer) error {
+	if rec.log != nil {
+		return rec.log.follow(w)
+	}
+	if r.logs == nil {
+		return errNoLog
+	}
+	f, err := r.logs.open(rec.ID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+//number of builds of this process with the given status
+func (r *buildRegistry) count(status buildStatus) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, rec := range r.builds {
+		if rec.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+//check if repo has a queued or running build
+func (r *buildRegistry) running(repo string) bool {
+	for _, rec := range r.list(repo) {
+		if rec.active() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *buildRegistry) cancel(id string) error {
+	rec, ok := r.get(id)
+	if !ok {
+		return fmt.Errorf("build %s not found", id)
+	}
+	if !rec.active() {
+		return fmt.Errorf("build %s is not running (%s)", id, rec.Status)
+	}
+	rec.cancel()
+	return nil
+}
+
+//cancel the queued or running builds of the same branch as rec, returns the cancelled builds
+func (r *buildRegistry) supersede(rec *buildRecord) []buildRecord {
+	r.Lock()
+	defer r.Unlock()
+	cancelled := []buildRecord{}
+	for _, b := range r.builds {
+		if b != rec && b.active() && b.Repo == rec.Repo && b.RefName == rec.RefName {
+			b.SupersededBy = rec.ID
+			b.cancel()
+			r.persist(b)
+			cancelled = append(cancelled, *b)
+		}
+	}
+	return cancelled
+}
+
+//cancel all queued and running builds
+func (r *buildRegistry) cancelAll() {
+	for _, rec := range r.list("") {
+		if rec.active() {
+			log.Infof("cancelling build %s of %s", rec.ID, rec.Repo)
+			rec.cancel()
+		}
+	}
+}
+
+//refuse new builds, no build can be added while waiting for the running ones
+func (r *buildRegistry) stopAccepting() {
+	r.Lock()
+	defer r.Unlock()
+	r.shuttingDown = true
+}
+
+//wait for running builds to finish, returns false on timeout. stopAccepting must be called first
+func (r *buildRegistry) wait(timeout time.Duration) bool {
+	return waitTimeout(&r.active, timeout)
+}
+
+//in memory build output that can be followed by several readers, also written to file if set
+type buildLog struct {
+	sync.Mutex
+	buf      []byte
+	closed   bool
+	updated  chan struct{} //closed and replaced on each write
+	file     io.WriteCloser
+	archived bool //the whole output was written to file
+}
+
+func newBuildLog() *buildLog {
+	return &buildLog{updated: make(chan struct{})}
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	l.buf = append(l.buf, p...)
+	if l.file != nil {
+		if _, err := l.file.Write(p); err != nil {
+			log.Errorf("unable to write build log: %v", err)
+			l.file.Close()
+			l.file = nil
+		}
+	}
+	close(l.updated)
+	l.updated = make(chan struct{})
+	return len(p), nil
+}
+
+func (l *buildLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.updated)
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			log.Errorf("unable to write build log: %v", err)
+		} else {
+			l.archived = true
+		}
+	}
+}
+
+//write the whole log to w, and the following output until the build finishes
+func (l *buildLog) follow(w io.Writer) error {
+	offset := 0
+	for {
+		l.Lock()
+		data := l.buf[offset:]
+		closed := l.closed
+		updated := l.updated
+		l.Unlock()
+
+		if len(data) > 0 {
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			offset += len(data)
+		}
+		if closed {
+			return nil
+		}
+		<-updated
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSupersede(t *testing.T) {
+	r := newBuildRegistry()
+	start := func(ref, refName string) (*buildRecord, context.Context) {
+		rec, ctx, err := r.start(context.Background(), &buildRequest{Repo: "app", Ref: ref, RefName: refName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec, ctx
+	}
+
+	old, oldCtx := start("a1", "refs/heads/master")
+	other, otherCtx := start("b1", "refs/heads/staging")
+	rec, _ := start("a2", "refs/heads/master")
+
+	cancelled := r.supersede(rec)
+	if len(cancelled) != 1 || cancelled[0].ID != old.ID {
+		t.Fatalf("expected build %s to be cancelled, got %v", old.ID, cancelled)
+	}
+	if oldCtx.Err() == nil {
+		t.Fatal("superseded build context should be cancelled")
+	}
+	if b, _ := r.get(old.ID); b.SupersededBy != rec.ID {
+		t.Fatalf("expected build to be superseded by %s, got %q", rec.ID, b.SupersededBy)
+	}
+	if otherCtx.Err() != nil {
+		t.Fatalf("build %s of another branch should not be cancelled", other.ID)
+	}
+
+	r.finish(old, nil, errBuildCancelled)
+	r.finish(other, nil, nil)
+	r.finish(rec, nil, nil)
+}
+
+func TestStartDuringShutdown(t *testing.T) {
+	r := newBuildRegistry()
+	rec, _, err := r.start(context.Background(), &buildRequest{Repo: "app", Ref: "a1", RefName: "refs/heads/master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.stopAccepting()
+	done := make(chan bool)
+	go func() {
+		done <- r.wait(5 * time.Second)
+	}()
+
+	//builds requested during the drain (e.g. from the hook socket or the API) are refused
+	for i := 0; i < 10; i++ {
+		if b, _, err := r.start(context.Background(), &buildRequest{Repo: "app", Ref: "a2", RefName: "refs/heads/master"}); err != errShuttingDown {
+			t.Fatalf("expected build to be refused during shutdown, got %v %v", b, err)
+		}
+	}
+	r.finish(rec, nil, nil)
+	if !<-done {
+		t.Fatal("expected running builds to be waited for")
+	}
+	if n := len(r.list("")); n != 1 {
+		t.Errorf("expected only the running build to be registered, got %d", n)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	maxConcurrentBuilds = runtime.NumCPU()
+
+	//queue position is written at this interval while waiting for a build slot
+	queueProgressInterval = 10 * time.Second
+
+	scheduler = newBuildScheduler(maxConcurrentBuilds)
+)
+
+func init() {
+	if s := os.Getenv("MAX_CONCURRENT_BUILDS"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			panic(fmt.Sprintf("invalid MAX_CONCURRENT_BUILDS: %q", s))
+		}
+		maxConcurrentBuilds = n
+		scheduler = newBuildScheduler(n)
+	}
+}
+
+type buildTicket struct {
+	repo  string
+	ready chan struct{} //closed when the build can start
+}
+
+//limit the number of concurrent builds, queued builds are started round robin between repos
+//so a repo with many pending builds doesn't delay the others
+type buildScheduler struct {
+	sync.Mutex
+	max     int
+	running int
+	queues  map[string][]*buildTicket
+	repos   []string //repos with queued builds, next one to be served first
+}
+
+func newBuildScheduler(max int) *buildScheduler {
+	return &buildScheduler{
+		max:    max,
+		queues: map[string][]*buildTicket{},
+	}
+}
+
+//wait for a build slot, the queue position is written to w while waiting. The returned func frees the slot
+func (s *buildScheduler) acquire(ctx context.Context, repo string, w io.Writer) (func(), error) {
+	s.Lock()
+	if s.running < s.max && len(s.repos) == 0 {
+		s.running++
+		s.Unlock()
+		return s.release, nil
+	}
+	t := &buildTicket{repo: repo, ready: make(chan struct{})}
+	if len(s.queues[repo]) == 0 {
+		s.repos = append(s.repos, repo)
+	}
+	s.queues[repo] = append(s.queues[repo], t)
+	position, running := s.position(t), s.running
+	s.Unlock()
+
+	fmt.Fprintf(w, "waiting for a build slot (position %d in queue, %d builds running)\n", position, running)
+	ticker := time.NewTicker(queueProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ready:
+			return s.release, nil
+		case <-ticker.C:
+			s.Lock()
+			position, running = s.position(t), s.running
+			s.Unlock()
+			if position == 0 {
+				continue //being started
+			}
+			if _, err := fmt.Fprintf(w, "waiting for a build slot (position %d in queue, %d builds running)\n", position, running); err != nil {
+				s.cancel(t)
+				return nil, err
+			}
+		case <-ctx.Done():
+			s.cancel(t)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//1 based position of t in the round robin order, 0 if not queued. Must be called with s locked
+func (s *buildScheduler) position(t *buildTicket) int {
+	n := 0
+	for round, found := 0, true; found; round++ {
+		found = false
+		for _, repo := range s.repos {
+			if q := s.queues[repo]; round < len(q) {
+				found = true
+				n++
+				if q[round] == t {
+					return n
+				}
+			}
+		}
+	}
+	return 0
+}
+
+//remove t from the queue, if it was started meanwhile its slot is freed
+func (s *buildScheduler) cancel(t *buildTicket) {
+	s.Lock()
+	q := s.queues[t.repo]
+	for i, ticket := range q {
+		if ticket == t {
+			s.queues[t.repo] = append(q[:i], q[i+1:]...)
+			if len(s.queues[t.repo]) == 0 {
+				s.removeRepo(t.repo)
+			}
+			s.Unlock()
+			return
+		}
+	}
+	s.Unlock()
+	s.release()
+}
+
+//must be called with s locked
+func (s *buildScheduler) removeRepo(repo string) {
+	delete(s.queues, repo)
+	for i, r := range s.repos {
+		if r == repo {
+			s.repos = append(s.repos[:i], s.repos[i+1:]...)
+			return
+		}
+	}
+}
+
+//free a slot and start the next build: the first build of the next repo
+func (s *buildScheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.running--
+	for s.running < s.max && len(s.repos) > 0 {
+		repo := s.repos[0]
+		q := s.queues[repo]
+		t := q[0]
+		s.queues[repo] = q[1:]
+		s.repos = s.repos[1:]
+		if len(s.queues[repo]) > 0 {
+			s.repos = append(s.repos, repo) //served again after the other repos
+		} else {
+			delete(s.queues, repo)
+		}
+		s.running++
+		close(t.ready)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBuildScheduler(t *testing.T) {
+	s := newBuildScheduler(1)
+	release, err := s.acquire(context.Background(), "api", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//api has 3 queued builds and web 1, web must not wait for all api builds
+	started := make(chan string, 4)
+	queue := func(repo string) {
+		go func() {
+			release, err := s.acquire(context.Background(), repo, ioutil.Discard)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			started <- repo
+			time.Sleep(10 * time.Millisecond)
+			release()
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	queue("api")
+	queue("api")
+	queue("web")
+	queue("api")
+
+	s.Lock()
+	if n := s.position(s.queues["web"][0]); n != 2 {
+		t.Errorf("web should be second in queue, got position %d", n)
+	}
+	s.Unlock()
+
+	release()
+	order := []string{}
+	for i := 0; i < 4; i++ {
+		select {
+		case repo := <-started:
+			order = append(order, repo)
+		case <-time.After(time.Second):
+			t.Fatalf("build %d never started (%v)", i, order)
+		}
+	}
+	if order[0] != "api" || order[1] != "web" {
+		t.Fatalf("expected web to be the second started build, got %v", order)
+	}
+}
+
+func TestBuildSchedulerCancel(t *testing.T) {
+	s := newBuildScheduler(1)
+	release, err := s.acquire(context.Background(), "api", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, "web", ioutil.Discard); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	release()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.running != 0 || len(s.repos) != 0 {
+		t.Fatalf("scheduler should be empty, got %d running and %v queued", s.running, s.repos)
+	}
+}
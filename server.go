@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,28 +9,47 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/robinmonjo/dockpack/auth"
 	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4"
 )
 
 const (
 	pushCmd      = "git-receive-pack"
 	pullCmd      = "git-upload-pack"
-	lockFile     = ".dockpack_lock"
 	publicKeyKey = "pub_key"
 )
 
 type server struct {
-	config     *ssh.ServerConfig
-	workingDir string
+	sync.Mutex
+	config         *ssh.ServerConfig
+	workingDir     string
+	authenticators auth.Multi //empty when authentication is disabled
+	hostKeys       []ssh.Signer
+
+	listener     net.Listener
+	shuttingDown bool
+	sessions     sync.WaitGroup //running git and management commands
+
+	conns   chan struct{} //one slot per open connection
+	limiter *rateLimiter
 }
 
 func newServer() (*server, error) {
+	authenticators, err := newAuthenticators()
+	if err != nil {
+		return nil, err
+	}
+
 	config := &ssh.ServerConfig{}
 	config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 		//storing public key and user for authorization processing
@@ -39,64 +59,208 @@ func newServer() (*server, error) {
 		authInfo := map[string]string{
 			"user":       c.User(),
 			"public_key": string(pk),
+			"identity":   c.User(),
+		}
+
+		//unknown keys are rejected during the handshake, repository access is checked on exec
+		if len(authenticators) > 0 {
+			identity, backend, err := authenticators.AuthenticateKey(c.User(), string(pk), c.RemoteAddr())
+			if err != nil {
+				log.Infof("authentication of %s from %s failed: %v", c.User(), c.RemoteAddr(), err)
+				authFailures.WithLabelValues("key").Inc()
+				return nil, err
+			}
+			authInfo["identity"] = identity
+			authInfo["backend"] = strconv.Itoa(backend) //the identity is only known by this backend
 		}
 
 		return &ssh.Permissions{CriticalOptions: authInfo}, nil
 	}
 
-	keyPath := "./id_rsa"
-	pkBytes, err := ioutil.ReadFile(keyPath)
+	hostKeys, err := loadHostKeys()
 	if err != nil {
 		return nil, err
 	}
-
-	pk, err := ssh.ParsePrivateKey(pkBytes)
+	for _, hk := range hostKeys {
+		log.Infof("host key %s %s", hk.PublicKey().Type(), ssh.FingerprintSHA256(hk.PublicKey()))
+		config.AddHostKey(hk)
+	}
+	workingDir, err := filepath.Abs("./sandbox")
 	if err != nil {
 		return nil, err
 	}
-	config.AddHostKey(pk)
-	workingDir, err := filepath.Abs("./sandbox")
+
+	s := &server{
+		config:         config,
+		workingDir:     workingDir,
+		authenticators: authenticators,
+		hostKeys:       hostKeys,
+		conns:          make(chan struct{}, maxConnections),
+		limiter:        newRateLimiter(connRateLimit),
+	}
+
+	apps, err := s.listApps()
 	if err != nil {
 		return nil, err
 	}
+	locks.clearStaleLocks(apps)
+	return s, nil
+}
+
+//authentication backends chosen with AUTH_BACKEND (github, file, cert or none), several backends can be
+//combined with a comma (e.g. file,cert)
+func newAuthenticators() (auth.Multi, error) {
+	backends := os.Getenv("AUTH_BACKEND")
+	if backends == "" && os.Getenv("GITHUB_AUTH") == "true" {
+		backends = "github"
+	}
 
-	return &server{
-		config:     config,
-		workingDir: workingDir,
-	}, nil
+	multi := auth.Multi{}
+	for _, backend := range strings.Split(backends, ",") {
+		a, err := newBackend(strings.TrimSpace(backend))
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			multi = append(multi, a)
+		}
+	}
+
+	if len(multi) == 0 {
+		log.Warn("authentication disabled, anyone reaching the server can push")
+	}
+	return multi, nil
 }
 
+func newBackend(backend string) (auth.Authenticator, error) {
+	switch backend {
+	case "github":
+		log.Info("using github authentication")
+		return auth.NewGithubAuth()
+	case "file":
+		path := os.Getenv("AUTHORIZED_KEYS")
+		if path == "" {
+			path = "sandbox/authorized_keys"
+		}
+		log.Infof("using authorized keys of %s", path)
+		return auth.NewFileAuth(path)
+	case "cert":
+		caPath := os.Getenv("USER_CA_KEYS")
+		if caPath == "" {
+			caPath = "sandbox/user_ca.pub"
+		}
+		principalsPath := os.Getenv("USER_CA_PRINCIPALS")
+		if principalsPath == "" {
+			principalsPath = "sandbox/principals.json"
+		}
+		log.Infof("using certificates signed by %s", caPath)
+		return auth.NewCertAuth(caPath, principalsPath)
+	case "", "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown auth backend %q", backend)
+}
+
+//accept ssh connections until shutdown is called
 func (s *server) start(port string) error {
 	socket, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
 	if err != nil {
 		return err
 	}
+	s.Lock()
+	s.listener = socket
+	s.Unlock()
+
 	log.Infof("Server listening on :%s :)", port)
 	for {
 		conn, err := socket.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return nil
+			}
 			log.Errorf("unable to accept connection %v", err)
 			continue
 		}
 
-		// From a standard TCP connection to an encrypted SSH connection
-		sshConn, newChans, _, err := ssh.NewServerConn(conn, s.config)
-		if err != nil {
-			log.Errorf("ssh handshake failed, %v", err)
+		if !s.limiter.allow(remoteIP(conn)) {
+			log.Warnf("rate limit exceeded, rejecting connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		select {
+		case s.conns <- struct{}{}:
+		default:
+			log.Warnf("too many connections (%d), rejecting connection from %s", maxConnections, conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-		defer sshConn.Close()
 
-		log.Infof("connection from %s", sshConn.RemoteAddr())
-		go func() {
-			for chanReq := range newChans {
-				go s.handleChanReq(chanReq, sshConn.Permissions.CriticalOptions)
-			}
-		}()
+		//the handshake is done in its own goroutine so slow clients don't block the others
+		go s.handleConn(conn)
+	}
+}
+
+func (s *server) handleConn(c net.Conn) {
+	defer func() { <-s.conns }()
+	sshConnections.Inc()
+	defer sshConnections.Dec()
+	conn := &idleConn{Conn: c}
+	defer conn.Close()
+
+	// From a standard TCP connection to an encrypted SSH connection
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sshConn, newChans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Errorf("ssh handshake failed, %v", err)
+		return
+	}
+	defer sshConn.Close()
+	conn.setIdleTimeout(idleTimeout)
+
+	log.Infof("connection from %s", sshConn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	//cancelled when the client disconnects, this cancels its builds
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for chanReq := range newChans {
+		go s.handleChanReq(ctx, sshConn, chanReq, sshConn.Permissions.CriticalOptions)
+	}
+}
+
+//stop accepting connections and commands, running commands are not interrupted
+func (s *server) stopAccepting() {
+	s.Lock()
+	defer s.Unlock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *server) isShuttingDown() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.shuttingDown
+}
+
+//register a running command, returns false if the server is shutting down
+func (s *server) addSession() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.shuttingDown {
+		return false
 	}
+	s.sessions.Add(1)
+	return true
+}
+
+//wait for running commands to finish, returns false on timeout
+func (s *server) wait(timeout time.Duration) bool {
+	return waitTimeout(&s.sessions, timeout)
 }
 
-func (s *server) handleChanReq(chanReq ssh.NewChannel, authInfo map[string]string) {
+func (s *server) handleChanReq(ctx context.Context, conn ssh.Conn, chanReq ssh.NewChannel, authInfo map[string]string) {
 	if chanReq.ChannelType() != "session" {
 		chanReq.Reject(ssh.Prohibited, "channel type is not a session")
 		return
@@ -114,7 +278,10 @@ func (s *server) handleChanReq(chanReq ssh.NewChannel, authInfo map[string]strin
 		switch req.Type {
 		case "env":
 		case "exec":
-			s.handleExec(ch, req, authInfo)
+			//builds may not print anything for a while (e.g. pulling a large image)
+			stop := keepAlive(conn, idleTimeout/2)
+			s.handleExec(ctx, ch, req, authInfo)
+			stop()
 			return
 		default:
 			ch.Write([]byte(fmt.Sprintf("request type %q not allowed\r\n", req.Type)))
@@ -124,31 +291,34 @@ func (s *server) handleChanReq(chanReq ssh.NewChannel, authInfo map[string]strin
 	}
 }
 
-func (s *server) handleExec(ch ssh.Channel, req *ssh.Request, authInfo map[string]string) {
+func (s *server) handleExec(ctx context.Context, ch ssh.Channel, req *ssh.Request, authInfo map[string]string) {
 	defer ch.Close()
-	args := strings.SplitN(string(req.Payload[4:]), " ", 2) //remove the 4 bytes of git protocol indicating line length
+	if !s.addSession() {
+		ch.Stderr().Write([]byte("dockpack is shutting down, try again later\n"))
+		ch.SendRequest("exit-status", false, ssh.Marshal(exitStatusResp{1}))
+		return
+	}
+	defer s.sessions.Done()
+
+	payload := string(req.Payload[4:]) //remove the 4 bytes of git protocol indicating line length
+	args := strings.SplitN(payload, " ", 2)
 	command := args[0]
-	repo := strings.TrimSuffix(strings.TrimPrefix(args[1], "'/"), ".git'")
 
-	//auth the user
-	if os.Getenv("GITHUB_AUTH") == "true" {
-		gauth, err := auth.NewGithubAuth()
+	//management commands (ssh dockpack builds)
+	if _, ok := commands[command]; ok {
+		err := s.handleCommand(ch, strings.Fields(payload), authInfo)
 		if err != nil {
-			writePktLine(fmt.Sprintf("github auth error, contact an administrator: %s", err), ch)
-			return
-		}
-
-		if err := gauth.Authenticate(authInfo["user"], authInfo["public_key"], repo); err != nil {
-			writePktLine(fmt.Sprintf("github auth failed: %s", err), ch)
-			return
+			ch.Stderr().Write([]byte(err.Error() + "\n"))
 		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(exitStatus(err)))
+		return
 	}
 
 	//check if allowed command
 	allowed := []string{pullCmd, pushCmd}
 	ok := false
 	for _, c := range allowed {
-		if command == c {
+		if command == c && len(args) == 2 {
 			ok = true
 			break
 		}
@@ -160,23 +330,56 @@ func (s *server) handleExec(ch ssh.Channel, req *ssh.Request, authInfo map[strin
 		return
 	}
 
+	repo, err := parseRepoName(args[1])
+	if err != nil {
+		log.Infof("invalid repo %s: %v", args[1], err)
+		writePktLine("ERR "+err.Error(), ch)
+		ch.SendRequest("exit-status", false, ssh.Marshal(exitStatus(err)))
+		return
+	}
+
+	//the key was checked during the handshake, check the user can access the repo
+	if err := s.authorize(authInfo, repo); err != nil {
+		log.Infof("%s: %v", authInfo["identity"], err)
+		writePktLine("ERR "+err.Error(), ch) //displayed by git as a remote error
+		ch.SendRequest("exit-status", false, ssh.Marshal(exitStatus(err)))
+		return
+	}
+
 	log.Infof("receiving %s command for repo %s", command, repo)
 
-	repoPath, err := s.prepareRepo(repo)
+	repoPath, err := s.createRepoIfNeeded(repo)
 	if err != nil {
 		log.Errorf("unable to create repo: %v", err)
-		writePktLine(err.Error(), ch)
+		writePktLine("ERR "+err.Error(), ch)
 		return
 	}
 
-	defer func() {
-		if err := s.unlockRepo(repo); err != nil {
-			log.Errorf("unable to unlock repo: %v", err)
-			writePktLine(err.Error(), ch)
+	//always inject the hooks as the dockpack binary or the repo config may change, not needed by the native backend
+	if command == pushCmd && !nativeGit {
+		if err := s.injectHooks(repo); err != nil {
+			log.Errorf("unable to inject hooks: %v", err)
+			writePktLine("ERR "+err.Error(), ch)
+			return
 		}
-	}()
+	}
+
+	if nativeGit {
+		if command == pushCmd {
+			err = s.serveReceivePack(ctx, ch, repo, repoPath, authInfo["identity"])
+		} else {
+			err = s.serveUploadPack(ctx, ch, repoPath)
+		}
+		if err != nil {
+			log.Errorf("%s failed: %v", command, err)
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(exitStatus(err)))
+		return
+	}
 
 	cmd := exec.Command(command, repoPath)
+	//the hook records who pushed
+	cmd.Env = append(os.Environ(), "DOCKPACK_PUSHER="+authInfo["identity"])
 	wg, err := attachCmd(cmd, ch)
 	if err != nil {
 		log.Errorf("unable to attach command stdio: %v", err)
@@ -184,122 +387,211 @@ func (s *server) handleExec(ch ssh.Channel, req *ssh.Request, authInfo map[strin
 		return
 	}
 
+	//own process group so the hook and its build request can be killed with git
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	if err := cmd.Start(); err != nil {
 		log.Errorf("unable to start command: %v", err)
 		writePktLine(err.Error(), ch)
 		return
 	}
+
+	//the client is gone, kill git and the hook: the build request is interrupted which cancels the build
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Infof("client disconnected, killing %s of %s", command, repo)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
 	wg.Wait()
 	syscallErr := cmd.Wait()
 
 	ch.SendRequest("exit-status", false, ssh.Marshal(exitStatus(syscallErr)))
 }
 
-func (s *server) prepareRepo(repo string) (string, error) {
-	var lock = &sync.Mutex{}
-	lock.Lock()
-	defer lock.Unlock()
+//app names are lower case (as docker image names) and may be prefixed by an organization (e.g. org/app)
+var repoNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*(/[a-z0-9][a-z0-9._-]*)?$`)
 
-	repoPath, err := s.createRepoIfNeeded(repo)
-	if err != nil {
-		return "", err
+//parse the repository path sent by git ('/org/app.git') into an app name (org/app)
+func parseRepoName(arg string) (string, error) {
+	name := strings.Trim(arg, "'")
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".git")
+	if !repoNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid repository name %q, expecting app.git or org/app.git (lower case letters, digits, '.', '_' and '-')", arg)
+	}
+	if !validAppName(name) {
+		return "", fmt.Errorf("invalid repository name %q", arg)
 	}
+	return name, nil
+}
 
-	var err2 error
-	if err := s.lockRepo(repo); err != nil {
-		return "", err
+var (
+	//the sandbox also holds per app files (<app>_clone, <app>_cache.tar, <app>_<sha>.tar and the <app>.log
+	//of previous versions), apps named like them would be overwritten or deleted with another app
+	reservedAppSuffixes = []string{".git", "_clone", ".tar", ".log"}
+
+	//folders and files of the sandbox used by dockpack (default locations of the config, the build store,
+	//the hook socket and the auth files), an app created in place of one of them would break all builds
+	reservedAppNames = []string{"logs", "host_keys", "dockpack.json", "dockpack.db", "dockpack.sock", "authorized_keys", "user_ca.pub", "principals.json"}
+)
+
+func validAppName(name string) bool {
+	if !repoNameRegexp.MatchString(name) {
+		return false
 	}
-	defer func() {
-		if err2 != nil {
-			if err := s.unlockRepo(repo); err != nil {
-				log.Errorf("unable to unlock repo: %v", err)
+	parts := strings.Split(name, "/")
+	for _, reserved := range reservedAppNames {
+		if parts[0] == reserved {
+			return false
+		}
+	}
+	for _, part := range parts {
+		for _, suffix := range reservedAppSuffixes {
+			if strings.HasSuffix(part, suffix) {
+				return false
 			}
 		}
-	}()
+	}
+	return true
+}
+
+//check the user authenticated during the handshake can access repo
+func (s *server) authorize(authInfo map[string]string, repo string) error {
+	if repo == "" {
+		return nil
+	}
+	if err := s.checkAccess(authInfo, repo); err != nil {
+		authFailures.WithLabelValues("repo").Inc()
+		return fmt.Errorf("auth failed: %s", err)
+	}
+	return nil
+}
 
-	//always inject pre-receive hook as http port may changes
-	err2 = s.injectPreReceiveHook(repo)
-	return repoPath, err2
+//listings only show the repos the user can access, hidden repos are not counted as auth failures
+func (s *server) canAccess(authInfo map[string]string, repo string) bool {
+	return s.checkAccess(authInfo, repo) == nil
+}
+
+func (s *server) checkAccess(authInfo map[string]string, repo string) error {
+	if len(s.authenticators) == 0 {
+		return nil
+	}
+	backend, err := strconv.Atoi(authInfo["backend"])
+	if err != nil {
+		return fmt.Errorf("unknown authentication backend")
+	}
+	return s.authenticators.Authorize(backend, authInfo["identity"], repo)
 }
 
 func (s *server) createRepoIfNeeded(repo string) (string, error) {
 	path := filepath.Join(s.workingDir, repo)
 
-	if _, err := os.Stat(path); err == nil {
+	//an organization can't be an app and conversely
+	if org := filepath.Dir(repo); org != "." && isBareRepo(filepath.Join(s.workingDir, org)) {
+		return "", fmt.Errorf("%s is an app, it can't contain other apps", org)
+	}
+	if _, err := os.Stat(path); err == nil && !isBareRepo(path) {
+		return "", fmt.Errorf("%s is an organization, not an app", repo)
+	}
+
+	//organization folder
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	if nativeGit {
+		if _, err := os.Stat(path); err != nil {
+			if _, err := git.PlainInit(path, true); err != nil {
+				return "", err
+			}
+		}
 		return path, nil
 	}
 
-	if err := exec.Command("git", "--git-dir="+path, "init", "--bare").Run(); err != nil {
+	if _, err := os.Stat(path); err != nil {
+		if err := exec.Command("git", "--git-dir="+path, "init", "--bare").Run(); err != nil {
+			return "", err
+		}
+	}
+
+	//let clients send build parameters using git push -o
+	if err := exec.Command("git", "--git-dir="+path, "config", "receive.advertisePushOptions", "true").Run(); err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
-func (s *server) injectPreReceiveHook(repo string) error {
-	path := filepath.Join(s.workingDir, repo, "hooks", "pre-receive")
-	if err := os.RemoveAll(path); err != nil {
+//synchronous builds run from the pre-receive hook, async ones from the post-receive hook (once refs are updated)
+func (s *server) injectHooks(repo string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("unable to load config: %v", err)
+	}
+	hook, unused := "pre-receive", "post-receive"
+	if cfg.async(repo) {
+		hook, unused = unused, hook
+	}
+	if err := os.RemoveAll(filepath.Join(s.workingDir, repo, "hooks", unused)); err != nil {
+		return err
+	}
+	return s.injectHook(repo, hook)
+}
+
+func (s *server) injectHook(repo, hook string) error {
+	path := filepath.Join(s.workingDir, repo, "hooks", hook)
+	//repositories created by the native backend have no hooks directory
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	f, err := os.Create(path)
+	//written aside and renamed as another push may be running the hook
+	f, err := ioutil.TempFile(filepath.Dir(path), hook)
 	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(f.Name())
 	defer f.Close()
 	if err := f.Chmod(0777); err != nil {
 		return err
 	}
 
+	//the hook runs the dockpack binary, it may have been moved since the last push
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
 	const script = `#!/bin/sh
-set -e
-while read old_ref new_ref ref_name
-do
-  if [[ $ref_name = "refs/heads/master" ]]; then
-    git archive -o {{.ArchiveFolder}}/{{.Repo}}_$new_ref.tar $new_ref
-		mkdir -p {{.ArchiveFolder}}/{{.Repo}}_clone
-		tar xf {{.ArchiveFolder}}/{{.Repo}}_$new_ref.tar -C {{.ArchiveFolder}}/{{.Repo}}_clone
-    curl -N -s -m 3600 -X PUT -H 'Content-Type: application/json' -d "{\"repo\": \"{{.Repo}}\", \"ref\": \"$new_ref\"}" {{.Endpoint}} | tee {{.BuildLogs}}
-		if grep -q "{{.BuildErrorPrefix}}" {{.BuildLogs}} ; then
-			exit 1
-		fi
-  fi
-done
-
-exit 0
-  `
+exec {{.Bin}} hook {{.Hook}} --repo {{.Repo}} --sandbox {{.Sandbox}}
+`
 	type hookData struct {
-		Repo             string
-		Endpoint         string
-		ArchiveFolder    string
-		BuildLogs        string
-		BuildErrorPrefix string
+		Bin     string
+		Hook    string
+		Repo    string
+		Sandbox string
 	}
 
 	data := hookData{
-		Repo:             repo,
-		Endpoint:         fmt.Sprintf("localhost:%s", httpPort),
-		ArchiveFolder:    s.workingDir,
-		BuildLogs:        filepath.Join(s.workingDir, fmt.Sprintf("%s.log", repo)),
-		BuildErrorPrefix: buildErrorPrefix,
+		Bin:     shellQuote(bin),
+		Hook:    hook,
+		Repo:    shellQuote(repo),
+		Sandbox: shellQuote(s.workingDir),
 	}
 
-	return template.Must(template.New("hook").Parse(script)).Execute(f, data)
-}
-
-func (s *server) lockFilePath(repo string) string {
-	return filepath.Join(s.workingDir, repo, lockFile)
-}
-
-func (s *server) lockRepo(repo string) error {
-	lockFilePath := s.lockFilePath(repo)
-	if _, err := os.Stat(lockFilePath); err == nil {
-		return fmt.Errorf("repo is locked, try again later")
+	if err := template.Must(template.New("hook").Parse(script)).Execute(f, data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
-	_, err := os.Create(lockFilePath)
-	return err
+	return os.Rename(f.Name(), path)
 }
 
-func (s *server) unlockRepo(repo string) error {
-	return os.RemoveAll(s.lockFilePath(repo))
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
 }
 
 func attachCmd(cmd *exec.Cmd, ch ssh.Channel) (*sync.WaitGroup, error) {
@@ -322,6 +614,7 @@ func attachCmd(cmd *exec.Cmd, ch ssh.Channel) (*sync.WaitGroup, error) {
 	go func() {
 		defer wg.Done()
 		io.Copy(stdin, ch)
+		stdin.Close() //the client is gone, don't let the command wait for input (and hold the repo lock) forever
 	}()
 
 	go func() {
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseRepoName(t *testing.T) {
+	valid := map[string]string{
+		"'/app.git'":        "app",
+		"'app.git'":         "app",
+		"'/app'":            "app",
+		"'/my-app_2.0.git'": "my-app_2.0",
+		"'/org/app.git'":    "org/app",
+	}
+	for arg, expected := range valid {
+		name, err := parseRepoName(arg)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", arg, err)
+		}
+		if name != expected {
+			t.Errorf("%s: expected %q, got %q", arg, expected, name)
+		}
+	}
+
+	invalid := []string{
+		"'/../app.git'",
+		"'/org/../../app.git'",
+		"'/a/b/c.git'",
+		"'//app.git'",
+		"'/.app.git'",
+		"'/App.git'",
+		"'/my app.git'",
+		"'/app;rm -rf.git'",
+		"'/$(id).git'",
+		"'/app.git.git'",
+		"'/app_clone.git'",
+		"'/app_cache.tar.git'",
+		"'/app_a1b2c3.tar.git'",
+		"'/app.log.git'",
+		"'/org_cache.tar/app.git'",
+		"'/logs.git'",
+		"'/host_keys/app.git'",
+		"'/dockpack.json.git'",
+		"'/dockpack.db.git'",
+		"'/dockpack.sock/app.git'",
+		"'/authorized_keys.git'",
+		"'/user_ca.pub.git'",
+		"'/principals.json.git'",
+		"''",
+	}
+	for _, arg := range invalid {
+		if name, err := parseRepoName(arg); err == nil {
+			t.Errorf("%s: expected an error, got %q", arg, name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	storePath    = "sandbox/dockpack.db"
+	buildsBucket = []byte("builds")
+
+	//index of the builds by queue time: keys are the time (unix nanoseconds, 8 bytes big endian)
+	//followed by the build id, values are the repos
+	queueBucket = []byte("builds_by_queue_time")
+)
+
+func init() {
+	if p := os.Getenv("DOCKPACK_DB"); p != "" {
+		storePath = p
+	}
+}
+
+//build history persisted in a bolt database, builds are stored as JSON by id
+type buildStore struct {
+	db *bolt.DB
+}
+
+func openBuildStore(path string) (*buildStore, error) {
+	//the database is locked by a running dockpack
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open build store %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		builds, err := tx.CreateBucketIfNotExists(buildsBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(queueBucket) != nil {
+			return nil
+		}
+		//databases of previous versions aren't indexed
+		index, err := tx.CreateBucket(queueBucket)
+		if err != nil {
+			return err
+		}
+		return builds.ForEach(func(k, v []byte) error {
+			var rec buildRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			return index.Put(queueKey(&rec), []byte(rec.Repo))
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &buildStore{db: db}, nil
+}
+
+func (s *buildStore) close() error {
+	return s.db.Close()
+}
+
+func (s *buildStore) save(rec *buildRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(queueBucket).Put(queueKey(rec), []byte(rec.Repo)); err != nil {
+			return err
+		}
+		return tx.Bucket(buildsBucket).Put([]byte(rec.ID), data)
+	})
+}
+
+func queueKey(rec *buildRecord) []byte {
+	key := make([]byte, 8, 8+len(rec.ID))
+	binary.BigEndian.PutUint64(key, uint64(rec.queueTime().UnixNano()))
+	return append(key, rec.ID...)
+}
+
+func (s *buildStore) get(id string) (buildRecord, bool, error) {
+	var rec buildRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(buildsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &rec)
+	})
+	return rec, found, err
+}
+
+//the max most recently queued builds of the repos matching match, most recent first. Only these
+//builds are read
+func (s *buildStore) list(max int, match func(repo string) bool) ([]buildRecord, error) {
+	res := []buildRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		builds := tx.Bucket(buildsBucket)
+		c := tx.Bucket(queueBucket).Cursor()
+		for k, repo := c.Last(); k != nil && len(res) < max; k, repo = c.Prev() {
+			if !match(string(repo)) {
+				continue
+			}
+			var rec buildRecord
+			if err := json.Unmarshal(builds.Get(k[8:]), &rec); err != nil {
+				return err
+			}
+			res = append(res, rec)
+		}
+		return nil
+	})
+	return res, err
+}
+
+//builds left queued or running by a previous dockpack process are marked as failed
+func (s *buildStore) failInterrupted() ([]buildRecord, error) {
+	interrupted := []buildRecord{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(buildsBucket)
+		updates := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			var rec buildRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if !rec.active() {
+				return nil
+			}
+			rec.Status = statusFailed
+			rec.Error = "interrupted by a dockpack restart"
+			rec.FinishedAt = time.Now()
+			data, err := json.Marshal(&rec)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = data
+			interrupted = append(interrupted, rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		//the bucket can't be modified while iterating
+		for k, data := range updates {
+			if err := b.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return interrupted, err
+}
+
+type byQueueDesc []buildRecord
+
+func (b byQueueDesc) Len() int           { return len(b) }
+func (b byQueueDesc) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byQueueDesc) Less(i, j int) bool { return b[i].queueTime().After(b[j].queueTime()) }
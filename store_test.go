@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestStore(t *testing.T) (*buildStore, func()) {
+	dir, err := ioutil.TempDir("", "dockpack-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := openBuildStore(filepath.Join(dir, "dockpack.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, func() {
+		store.close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBuildStore(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	r := newBuildRegistry()
+	if err := r.useStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func(repo string) *buildRecord {
+		rec, _, _ := r.start(context.Background(), &buildRequest{Repo: repo, Ref: "a1", RefName: "refs/heads/master", Pusher: "alice", PushOptions: []string{"no-cache", "env.TOKEN=secret"}})
+		return rec
+	}
+	first := start("app")
+	time.Sleep(10 * time.Millisecond)
+	r.run(first)
+	if !first.StartedAt.After(first.QueuedAt) {
+		t.Errorf("expected queue time %s to be kept when the build runs at %s", first.QueuedAt, first.StartedAt)
+	}
+	r.finish(first, &buildResult{ImageName: "app", ImageTag: "v1", Procfile: map[string]string{"web": "./web"}}, nil)
+	second := start("app")
+	start("other")
+
+	rec, ok, err := store.get(first.ID)
+	if err != nil || !ok {
+		t.Fatalf("expected build %s to be stored: %v", first.ID, err)
+	}
+	if rec.Status != statusSucceeded || rec.Pusher != "alice" || rec.FinishedAt.IsZero() || rec.Result.ImageTag != "v1" || rec.Result.Procfile["web"] != "./web" {
+		t.Errorf("unexpected stored build %#v", rec)
+	}
+	if strings.Join(rec.PushOptions, " ") != "no-cache env.TOKEN" {
+		t.Errorf("expected env values to be redacted, got %v", rec.PushOptions)
+	}
+
+	builds, err := store.list(10, repoBuilds("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].ID != second.ID || builds[1].ID != first.ID {
+		t.Errorf("expected builds of app most recent first, got %v", builds)
+	}
+	if builds, _ := store.list(1, repoBuilds("")); len(builds) != 1 || builds[0].Repo != "other" {
+		t.Errorf("expected the most recent build only, got %v", builds)
+	}
+
+	//a new process only knows the builds through the store
+	r = newBuildRegistry()
+	if err := r.useStore(store); err != nil {
+		t.Fatal(err)
+	}
+	b, ok := r.get(second.ID)
+	if !ok || b.Status != statusFailed || b.Error == "" {
+		t.Errorf("expected build interrupted by the restart to be failed, got %#v", b)
+	}
+	if err := r.followLog(b, ioutil.Discard); err != errNoLog {
+		t.Errorf("expected logs of a previous process to be unavailable")
+	}
+	if history := r.history(10, repoBuilds("")); len(history) != 3 {
+		t.Errorf("expected 3 builds in history, got %v", history)
+	}
+	if history := r.history(2, repoBuilds("app")); len(history) != 2 || history[0].ID != second.ID {
+		t.Errorf("expected the 2 builds of app in history, got %v", history)
+	}
+	if err := r.cancel(second.ID); err == nil {
+		t.Errorf("expected interrupted build cancel to fail")
+	}
+}
+
+//databases of previous versions have no queue time index
+func TestBuildStoreIndex(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	now := time.Now()
+	for i, id := range []string{"b", "c", "a"} {
+		rec := &buildRecord{ID: id, Repo: "app", Status: statusSucceeded, StartedAt: now.Add(time.Duration(i) * time.Minute)}
+		if err := store.save(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := store.db.Path()
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(queueBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+
+	store, err = openBuildStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds, err := store.list(2, repoBuilds("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].ID != "a" || builds[1].ID != "c" {
+		t.Errorf("expected builds a and c, got %v", builds)
+	}
+	store.close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+//end of a log stream, sent once the build is finished
+type logStreamEnd struct {
+	Type   string      `json:"type"`
+	Status buildStatus `json:"status"`
+	Error  string      `json:"error,omitempty"`
+}
+
+//log line sent to websocket watchers
+type logStreamLine struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+//calls emit for each line written, build output may be written in chunks that split lines
+type lineWriter struct {
+	emit func(line string) error
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		line := string(bytes.TrimSuffix(w.buf[:i], []byte("\r")))
+		w.buf = w.buf[i+1:]
+		if err := w.emit(line); err != nil {
+			return 0, err
+		}
+	}
+}
+
+//emit the last line if not terminated by a new line
+func (w *lineWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = nil
+	return w.emit(line)
+}
+
+//write the whole log of the build to emit and follow it until the build finishes, returns the final status
+func streamLog(id string, emit func(line string) error) (*logStreamEnd, error) {
+	rec, ok := registry.get(id)
+	if !ok {
+		return nil, fmt.Errorf("build %s not found", id)
+	}
+	lw := &lineWriter{emit: emit}
+	if err := registry.followLog(rec, lw); err != nil && err != errNoLog {
+		return nil, err
+	}
+	if err := lw.flush(); err != nil {
+		return nil, err
+	}
+	rec, _ = registry.get(id)
+	return &logStreamEnd{Type: "end", Status: rec.Status, Error: rec.Error}, nil
+}
+
+//Server-Sent Events: a message per log line and an "end" event with the build status
+func apiStreamLogs(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	if _, ok := registry.get(args[0]); !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	end, err := streamLog(args[0], func(line string) error {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		return //watcher gone
+	}
+	data, _ := json.Marshal(end)
+	fmt.Fprintf(w, "event: end\ndata: %s\n\n", data)
+	flusher.Flush()
+}
+
+//WebSocket: a JSON message per log line ({"type": "log", "data": "..."}) and an "end" message with the build status
+func apiWebSocketLogs(a *apiServer, w http.ResponseWriter, r *http.Request, args []string) {
+	if _, ok := registry.get(args[0]); !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("build %s not found", args[0]))
+		return
+	}
+	//no origin check, watchers are authenticated with the API token
+	ws := websocket.Server{Handler: func(conn *websocket.Conn) {
+		defer conn.Close()
+		end, err := streamLog(args[0], func(line string) error {
+			return websocket.JSON.Send(conn, &logStreamLine{Type: "log", Data: line})
+		})
+		if err == nil {
+			websocket.JSON.Send(conn, end)
+		}
+	}}
+	ws.ServeHTTP(w, r)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestLineWriter(t *testing.T) {
+	lines := []string{}
+	w := &lineWriter{emit: func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}}
+	w.Write([]byte("step 1\nstep"))
+	w.Write([]byte(" 2\r\n\nstep 3"))
+	w.flush()
+
+	expected := []string{"step 1", "step 2", "", "step 3"}
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected lines %q, got %q", expected, lines)
+	}
+}
+
+//a running build with some output, the returned func writes more output and finishes it
+func startTestStream(t *testing.T) (*httptest.Server, *buildRecord, func()) {
+	a, cleanup := newTestAPI(t)
+	srv := httptest.NewServer(a)
+	rec, _, _ := registry.start(context.Background(), &buildRequest{Repo: "app", Ref: "a1", RefName: "refs/heads/master"})
+	rec.log.Write([]byte("step 1\n"))
+	return srv, rec, func() {
+		rec.log.Write([]byte("step 2\n"))
+		registry.finish(rec, nil, errBuildCancelled)
+		srv.Close()
+		cleanup()
+	}
+}
+
+func TestStreamLogsEvents(t *testing.T) {
+	srv, rec, finish := startTestStream(t)
+
+	resp, err := http.Get(srv.URL + "/v1/builds/" + rec.ID + "/logs/events?access_token=secret")
+	if err != nil {
+		finish()
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		finish()
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	//the output logged before the watcher attached is replayed
+	if line, _ := r.ReadString('\n'); line != "data: step 1\n" {
+		t.Errorf("unexpected first event %q", line)
+	}
+	finish()
+
+	rest := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if line != "\n" {
+			rest = append(rest, line)
+		}
+	}
+	expected := []string{"data: step 2\n", "event: end\n", "data: {\"type\":\"end\",\"status\":\"cancelled\"}\n"}
+	if strings.Join(rest, "") != strings.Join(expected, "") {
+		t.Errorf("expected events %q, got %q", expected, rest)
+	}
+}
+
+func TestStreamLogsWebSocket(t *testing.T) {
+	srv, rec, finish := startTestStream(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/v1/builds/" + rec.ID + "/logs/ws?access_token=secret"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		finish()
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	var line logStreamLine
+	if err := websocket.JSON.Receive(ws, &line); err != nil || line.Data != "step 1" {
+		t.Errorf("unexpected first message %#v (%v)", line, err)
+	}
+	finish()
+	if err := websocket.JSON.Receive(ws, &line); err != nil || line.Data != "step 2" {
+		t.Errorf("unexpected second message %#v (%v)", line, err)
+	}
+	var end logStreamEnd
+	if err := websocket.JSON.Receive(ws, &end); err != nil || end.Type != "end" || end.Status != statusCancelled {
+		t.Errorf("unexpected end message %#v (%v)", end, err)
+	}
+}
+
+func TestStreamLogsAuth(t *testing.T) {
+	srv, rec, finish := startTestStream(t)
+	defer finish()
+
+	resp, err := http.Get(srv.URL + "/v1/builds/" + rec.ID + "/logs/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"fmt"
 	"io"
-	"net"
 	"os/exec"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type exitStatusResp struct {
@@ -31,12 +31,17 @@ func writePktLine(line string, w io.Writer) (int, error) {
 	return w.Write(append(head, payload...))
 }
 
-//return a free port
-func freePort() (string, error) {
-	l, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return "", err
+//wait for wg, returns false on timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
-	defer l.Close()
-	return strings.TrimPrefix(l.Addr().String(), "[::]:"), nil
 }
@@ -42,5 +42,9 @@ clone git github.com/Sirupsen/logrus v0.8.7
 clone git github.com/fsouza/go-dockerclient
 
 go get github.com/google/go-github/github
+go get go.etcd.io/bbolt
 go get golang.org/x/crypto/ssh
+go get golang.org/x/net/websocket
 go get golang.org/x/oauth2
+go get github.com/prometheus/client_golang/prometheus/...
+go get gopkg.in/src-d/go-git.v4/...